@@ -49,9 +49,10 @@ func main() {
 	}()
 
 	/*for i := 1; i <= 100; i++ {
-		err = appl.ProduceMsg(ctx, entity.Message{
-			ID:      uuid.New().String(),
-			Payload: fmt.Sprintf(`{"id": "%d", "name": "user_%d", "age": %d}`, i, i, i+7),
+		err = app.Produce(ctx, appl, entity.EventTypeUser, entity.User{
+			ID:   strconv.Itoa(i),
+			Name: fmt.Sprintf("user_%d", i),
+			Age:  i + 7,
 		})
 		if err != nil {
 			log.Fatal(err)
@@ -60,12 +61,45 @@ func main() {
 
 	return*/
 
+	go func() {
+		if err := appl.RunJanitor(ctx); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	go func() {
+		if err := appl.RunRetention(ctx); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	go func() {
+		if err := appl.RunScheduler(ctx); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	go func() {
+		if err := appl.RunSpool(ctx); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	go func() {
+		if err := appl.RunCron(ctx); err != nil {
+			log.Println(err)
+		}
+	}()
+
 	err = appl.RunConsumer(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err = appl.WaitShutdown(ctx); err != nil {
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), cfg.Redis.Consumer.ShutdownTimeout)
+	defer shutdownCancel()
+
+	if err = appl.WaitShutdown(shutdownCtx); err != nil {
 		log.Fatal(err)
 	}
 
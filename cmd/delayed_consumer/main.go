@@ -3,148 +3,67 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
 	"math/rand"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/redis/rueidis"
+	"github.com/veleton777/redis_queue/internal/app"
+	"github.com/veleton777/redis_queue/internal/config"
+	"github.com/veleton777/redis_queue/internal/entity"
+	"github.com/veleton777/redis_queue/internal/logger"
 )
 
-const (
-	delayedQueue = "delayed_queue"
-	defaultQueue = "default_queue"
-)
-
-type app struct {
-	rdb rueidis.Client
-}
-
-type task struct {
-	Message string
-	Score   int
-}
-
-type item struct {
-}
-
 func main() {
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	rdb, err := rueidis.NewClient(rueidis.ClientOption{
-		InitAddress: []string{"localhost:63791"},
-	})
+	cfg, err := config.LoadFromEnv()
 	if err != nil {
-		panic(err)
-	}
-	defer rdb.Close()
-
-	a := &app{rdb: rdb}
-
-	for i := 1; i <= 1000; i++ {
-		// randNumber := int64(rand.Intn(100_000_000_000))
-		randNumber := int64(rand.Intn(100_000))
-
-		cmd := rdb.B().Zadd().Key(delayedQueue).ScoreMember().
-			ScoreMember(
-				float64(time.Now().UTC().UnixNano()+randNumber),
-				fmt.Sprintf(`{"item": "task #%d"}`, i),
-			).Build()
-
-		err := rdb.Do(ctx, cmd).Error()
-		if err != nil {
-			panic(err)
-		}
+		log.Fatal(err)
 	}
 
-	// return
-
-	err = a.consumeMessages(ctx)
-	if err != nil {
-		panic(err)
-	}
-}
-
-func (a *app) consumeMessages(ctx context.Context) error {
 	f, err := os.Create("delayed_consumer:" + uuid.New().String())
 	if err != nil {
-		return fmt.Errorf("create file: %w", err)
+		log.Fatal(err)
 	}
 
 	defer f.Close()
 
-	for {
-		tasks, err := a.lastTasks(ctx)
-		if err != nil {
-			fmt.Printf("err get last tasks: %v\n", err)
-			continue
-		}
-
-		for _, t := range tasks {
-			err := a.moveTaskToQueue(ctx, t)
-			if err != nil {
-				fmt.Printf("execute task: %v\n", err)
-				continue
-			}
-
-			_, err = f.WriteString(fmt.Sprintf("moved task: %v\n", t.Message))
-			if err != nil {
-				fmt.Printf("write to file: %v\n", err)
-			}
-		}
-
-		time.Sleep(2 * time.Second)
-		fmt.Println("-----------")
+	appl, err := app.New(cfg, logger.NewFileLogger(f), "delayed_consumer")
+	if err != nil {
+		log.Fatal(err)
 	}
-}
-
-func (a *app) lastTasks(ctx context.Context) ([]task, error) {
-	cmd := a.rdb.B().Zrangebyscore().
-		Key(delayedQueue).
-		Min("0").
-		Max(fmt.Sprintf("%d", time.Now().UTC().UnixNano())).
-		Withscores().
-		Limit(0, 10).Build()
 
-	cmdRes := a.rdb.Do(ctx, cmd)
-	if cmdRes.Error() != nil {
-		return nil, fmt.Errorf("redis ZRangeByScore: %w", cmdRes.Error())
-	}
+	for i := 1; i <= 1000; i++ {
+		delay := time.Duration(rand.Intn(100_000)) * time.Millisecond
 
-	res, err := cmdRes.AsZScores()
-	if err != nil {
-		return nil, fmt.Errorf("redis AsZScores: %w", err)
+		_, err = appl.ProduceAfter(ctx, entity.EventTypeUser, entity.Message{
+			Payload: fmt.Sprintf(`{"id": "%d", "name": "task #%d"}`, i, i),
+		}, delay)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	tasks := make([]task, 0, len(res))
+	waitCh := make(chan os.Signal, 1)
 
-	for _, r := range res {
-		tasks = append(tasks, task{
-			Message: r.Member,
-			Score:   int(r.Score),
-		})
-	}
+	signal.Notify(waitCh, syscall.SIGINT, syscall.SIGTERM)
 
-	return tasks, nil
-}
+	go func() {
+		<-waitCh
+		cancel()
+	}()
 
-func (a *app) moveTaskToQueue(ctx context.Context, t task) error {
-	err := a.rdb.Do(
-		ctx,
-		a.rdb.B().Xadd().Key(defaultQueue).
-			Id("*").FieldValue().FieldValue("data", t.Message).Build(),
-	).Error()
+	err = appl.RunScheduler(ctx)
 	if err != nil {
-		return fmt.Errorf("redis xAdd: %w", err)
+		log.Fatal(err)
 	}
 
-	err = a.rdb.Do(
-		ctx,
-		a.rdb.B().Zrem().Key(delayedQueue).Member(t.Message).Build(),
-	).Error()
-	if err != nil {
-		return fmt.Errorf("redis zRem: %w", err)
+	if err = appl.WaitShutdown(context.Background()); err != nil {
+		log.Fatal(err)
 	}
-
-	return nil
 }
@@ -33,3 +33,10 @@ func (l *Logger) Success(msg string) {
 	defer l.mu.Unlock()
 	l.qtySuccess++
 }
+
+func (l *Logger) Successes() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.qtySuccess
+}
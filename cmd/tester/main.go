@@ -2,82 +2,70 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/redis/rueidis"
 	"github.com/veleton777/redis_queue/internal/app"
 	"github.com/veleton777/redis_queue/internal/config"
 	"github.com/veleton777/redis_queue/internal/entity"
 )
 
+const messagesCount = 1000
+
 func main() {
 	cfg, err := config.LoadFromEnv()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	redisClient, err := rueidis.NewClient(rueidis.ClientOption{
-		InitAddress: []string{cfg.Redis.Addr},
-		SelectDB:    cfg.Redis.DB,
-		Password:    cfg.Redis.Password,
-	})
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	fmt.Println("test 1")
 	now := time.Now()
-	exec(cfg, redisClient, 1)
+	exec(cfg, 1)
 	fmt.Println(time.Since(now)) // 1m 45s
 
 	fmt.Println("test 3")
 	now = time.Now()
-	exec(cfg, redisClient, 3) // 37s
+	exec(cfg, 3) // 37s
 	fmt.Println(time.Since(now))
 
 	fmt.Println("test 5")
 	now = time.Now()
-	exec(cfg, redisClient, 5) // 21s
+	exec(cfg, 5) // 21s
 	fmt.Println(time.Since(now))
 
 	fmt.Println("test 10")
 	now = time.Now()
-	exec(cfg, redisClient, 10) // 12s
+	exec(cfg, 10) // 12s
+	fmt.Println(time.Since(now))
+
+	fmt.Println("test 1 with concurrency 10")
+	now = time.Now()
+	cfg.Redis.Consumer.Concurrency = 10
+	exec(cfg, 1)
 	fmt.Println(time.Since(now))
 }
 
-func exec(cfg config.Config, rdb rueidis.Client, countWorkers int) {
+func exec(cfg config.Config, countWorkers int) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	l := NewLogger()
+
+	// acked messages stay in the stream, so the run is finished when all of them are handled
 	go func() {
 		time.Sleep(3 * time.Second)
 
-		for {
-			count, err := rdb.Do(
-				ctx,
-				rdb.B().Xlen().Key(cfg.Redis.Consumer.Queue).Build(),
-			).AsInt64()
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			if count == 0 {
-				break
-			}
-
+		for l.Successes() < messagesCount {
 			time.Sleep(1 * time.Second)
 		}
 
 		cancel()
 	}()
 
-	l := NewLogger()
-
 	apps := make([]*app.App, 0, countWorkers)
 
 	cfg.Redis.Consumer.Group = fmt.Sprintf("gr_%s", uuid.New().String())
@@ -94,13 +82,18 @@ func exec(cfg config.Config, rdb rueidis.Client, countWorkers int) {
 
 	go func() {
 		time.Sleep(500 * time.Millisecond)
-		for i := 1; i <= 1000; i++ {
-			err := apps[0].ProduceMsg(ctx, entity.Message{
-				ID:      "1",
+
+		messages := make([]entity.Message, 0, messagesCount)
+		for i := 1; i <= messagesCount; i++ {
+			messages = append(messages, entity.Message{
+				Type:    entity.EventTypeUser,
 				Payload: `{"id": "1", "name": "user_1", "age": 1}`,
 			})
-			if err != nil {
-				log.Fatal(err)
+		}
+
+		for _, r := range apps[0].ProduceBatch(ctx, messages) {
+			if r.Err != nil && !errors.Is(r.Err, entity.ErrSpooled) {
+				log.Fatal(r.Err)
 			}
 		}
 	}()
@@ -120,5 +113,11 @@ func exec(cfg config.Config, rdb rueidis.Client, countWorkers int) {
 
 	wg.Wait()
 
+	for _, appl := range apps {
+		if err := appl.WaitShutdown(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	fmt.Printf("success: %d\n", l.qtySuccess)
 }
@@ -2,28 +2,42 @@ package app
 
 import (
 	"context"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/redis/rueidis"
+	"github.com/veleton777/redis_queue/internal/codec"
 	"github.com/veleton777/redis_queue/internal/config"
 	"github.com/veleton777/redis_queue/internal/consumer"
 	"github.com/veleton777/redis_queue/internal/consumer/handler"
+	"github.com/veleton777/redis_queue/internal/cron"
 	"github.com/veleton777/redis_queue/internal/entity"
+	"github.com/veleton777/redis_queue/internal/lock"
 	"github.com/veleton777/redis_queue/internal/logger"
 	"github.com/veleton777/redis_queue/internal/producer"
 	"github.com/veleton777/redis_queue/internal/repository/redis"
+	"github.com/veleton777/redis_queue/internal/retention"
+	"github.com/veleton777/redis_queue/internal/scheduler"
+	"github.com/veleton777/redis_queue/internal/spool"
 	"golang.org/x/sync/errgroup"
 )
 
 type App struct {
 	redisClient rueidis.Client
-	consumer    *consumer.Consumer
+	repo        *redis.Repo
+	locker      *lock.Locker
+	groups      []*group
 	producer    *producer.Producer
+	streams     []consumer.Stream
+	retentions  []*retention.Retention
+	scheduler   *scheduler.Scheduler
+	cron        *cron.Cron
+	spool       *spool.Spool
 	config      config.Config
 	logger      logger.Logger
 	consumerID  string
 
-	queueShutDownFuncs []func() error
+	queueShutDownFuncs []func(ctx context.Context) error
 }
 
 func New(config config.Config, logger logger.Logger, consumerID string) (*App, error) {
@@ -51,66 +65,431 @@ func (a *App) buildDeps() error {
 	}
 
 	a.redisClient = redisClient
-	a.registerShutdown(func() error {
-		a.redisClient.Close()
 
-		return nil
+	repo := redis.NewRepo(a.redisClient)
+	a.repo = repo
+
+	enc, err := codec.NewEncoder(
+		a.config.Redis.Producer.Codec,
+		a.config.Redis.Producer.Compression,
+		a.config.Redis.Producer.CompressThreshold,
+	)
+	if err != nil {
+		return errors.Wrap(err, "create encoder")
+	}
+
+	repo.SetEncoder(a.config.Redis.Consumer.Queue, enc)
+
+	a.locker = lock.New(lock.Params{
+		Repo: repo,
+		Opts: lock.Opts{
+			TTL:           a.config.Redis.Lock.TTL,
+			RetryInterval: a.config.Redis.Lock.RetryInterval,
+		},
 	})
 
-	repo := redis.NewRepo(a.redisClient)
-	handlerSrv := handler.NewHandler()
-
-	a.consumer = consumer.New(consumer.Params{
-		Logger:  a.logger,
-		Repo:    repo,
-		Handler: handlerSrv,
-		Opts: consumer.Opts{
-			ID:                      a.consumerID,
-			TasksForIteration:       10,
-			Queue:                   a.config.Redis.Consumer.Queue,
-			Group:                   a.config.Redis.Consumer.Group,
-			CheckFailedMessagesTime: a.config.Redis.Consumer.IdleTimeForFailedTask,
-			IdleTimeForNewTask:      a.config.Redis.Consumer.IdleTimeForNewTask,
+	var priorities []entity.Priority
+
+	a.streams, priorities, err = a.buildStreams()
+	if err != nil {
+		return errors.Wrap(err, "build priority streams")
+	}
+
+	for _, name := range a.groupNames() {
+		g, err := a.buildGroup(name)
+		if err != nil {
+			return errors.Wrapf(err, "build group %s", name)
+		}
+
+		a.groups = append(a.groups, g)
+		a.registerShutdown(g.consumer.Shutdown)
+	}
+
+	for _, s := range a.streams {
+		a.retentions = append(a.retentions, retention.New(retention.Params{
+			Logger: a.logger,
+			Repo:   repo,
+			Opts: retention.Opts{
+				Queue:    s.Queue,
+				Policy:   retention.Policy(a.config.Redis.Retention.Policy),
+				MaxLen:   a.config.Redis.Retention.MaxLen,
+				MaxAge:   a.config.Redis.Retention.MaxAge,
+				Interval: a.config.Redis.Retention.Interval,
+			},
+		}))
+	}
+
+	a.scheduler = scheduler.New(scheduler.Params{
+		Logger: a.logger,
+		Repo:   repo,
+		Locker: a.locker,
+		Opts: scheduler.Opts{
+			Queue:    a.config.Redis.Consumer.Queue,
+			Interval: a.config.Redis.Scheduler.Interval,
+			Limit:    a.config.Redis.Scheduler.BatchSize,
 		},
 	})
 
-	a.producer = producer.New(producer.Params{
+	a.cron = cron.New(cron.Params{
 		Logger: a.logger,
 		Repo:   repo,
-		Opts: producer.Opts{
-			Queue: a.config.Redis.Consumer.Queue,
+		Opts: cron.Opts{
+			Queue:      a.config.Redis.Consumer.Queue,
+			Priorities: priorities,
+			Interval:   a.config.Redis.Cron.Interval,
+			MaxCatchUp: a.config.Redis.Cron.MaxCatchUp,
 		},
 	})
 
+	for _, job := range a.config.Redis.Cron.Jobs {
+		err = a.cron.AddJob(cron.Job{
+			Name:     job.Name,
+			Every:    job.Every,
+			Queue:    job.Queue,
+			Priority: entity.Priority(job.Priority),
+			Type:     entity.EventType(job.Type),
+			Payload:  job.Payload,
+			Missed:   cron.MissedPolicy(job.Missed),
+		})
+		if err != nil {
+			return errors.Wrap(err, "add cron job from config")
+		}
+	}
+
+	switch mode := entity.CapMode(a.config.Redis.Producer.CapMode); mode {
+	case entity.CapNone, entity.CapMaxLen, entity.CapMinID, entity.CapReject:
+	default:
+		return errors.Errorf("unknown cap mode: %s", mode)
+	}
+
+	producerParams := producer.Params{
+		Logger: a.logger,
+		Repo:   repo,
+		Opts: producer.Opts{
+			Queue:        a.config.Redis.Consumer.Queue,
+			DedupWindow:  a.config.Redis.Producer.DedupWindow,
+			MaxBatchSize: a.config.Redis.Producer.MaxBatchSize,
+			Cap: entity.StreamCap{
+				Mode:   entity.CapMode(a.config.Redis.Producer.CapMode),
+				MaxLen: a.config.Redis.Producer.CapMaxLen,
+				MaxAge: a.config.Redis.Producer.CapMaxAge,
+			},
+			ClaimCheck: entity.ClaimCheckPolicy{
+				Threshold: a.config.Redis.Producer.ClaimCheckThreshold,
+				TTL:       a.config.Redis.Producer.ClaimCheckTTL,
+			},
+			Priorities: priorities,
+		},
+	}
+
+	if a.config.Redis.Spool.Dir != "" {
+		a.spool, err = spool.New(spool.Params{
+			Logger: a.logger,
+			Repo:   repo,
+			Opts: spool.Opts{
+				Dir:      a.config.Redis.Spool.Dir,
+				Queue:    a.config.Redis.Consumer.Queue,
+				MaxSize:  a.config.Redis.Spool.MaxSize,
+				Interval: a.config.Redis.Spool.Interval,
+			},
+		})
+		if err != nil {
+			return errors.Wrap(err, "open spool")
+		}
+
+		producerParams.Spool = a.spool
+	}
+
+	a.producer = producer.New(producerParams)
+
 	return nil
 }
 
+// RunConsumer runs the consumers of all groups of the queue until ctx is cancelled.
 func (a *App) RunConsumer(ctx context.Context) error {
-	err := a.consumer.Run(ctx)
-	if err != nil {
+	g, gCtx := errgroup.WithContext(ctx)
+
+	for _, gr := range a.groups {
+		gr := gr
+
+		g.Go(func() error {
+			if err := gr.consumer.Run(gCtx); err != nil {
+				return errors.Wrapf(err, "group %s", gr.name)
+			}
+
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
 		return errors.Wrap(err, "run consumer")
 	}
 
 	return nil
 }
 
-func (a *App) ProduceMsg(ctx context.Context, message entity.Message) error {
-	err := a.producer.Produce(ctx, message)
+// RunJanitor removes dead consumers from all groups of the queue until ctx is cancelled.
+func (a *App) RunJanitor(ctx context.Context) error {
+	g, gCtx := errgroup.WithContext(ctx)
+
+	for _, gr := range a.groups {
+		for _, j := range gr.janitors {
+			gr, j := gr, j
+
+			g.Go(func() error {
+				if err := j.Run(gCtx); err != nil {
+					return errors.Wrapf(err, "group %s", gr.name)
+				}
+
+				return nil
+			})
+		}
+	}
+
+	if err := g.Wait(); err != nil {
+		return errors.Wrap(err, "run janitor")
+	}
+
+	return nil
+}
+
+// RunRetention trims the priority streams of the queue by the retention policy until ctx is cancelled.
+func (a *App) RunRetention(ctx context.Context) error {
+	g, gCtx := errgroup.WithContext(ctx)
+
+	for _, r := range a.retentions {
+		r := r
+
+		g.Go(func() error {
+			return r.Run(gCtx)
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return errors.Wrap(err, "run retention")
+	}
+
+	return nil
+}
+
+// RunScheduler moves due delayed messages into the queue until ctx is cancelled.
+func (a *App) RunScheduler(ctx context.Context) error {
+	err := a.scheduler.Run(ctx)
+	if err != nil {
+		return errors.Wrap(err, "run scheduler")
+	}
+
+	return nil
+}
+
+// RunSpool replays the messages spooled while redis was unavailable until ctx is cancelled,
+// it returns at once if the spool is disabled.
+func (a *App) RunSpool(ctx context.Context) error {
+	if a.spool == nil {
+		return nil
+	}
+
+	err := a.spool.Run(ctx)
+	if err != nil {
+		return errors.Wrap(err, "run spool")
+	}
+
+	return nil
+}
+
+// SpoolStats returns the size of the spool, false is returned if the spool is disabled.
+func (a *App) SpoolStats() (spool.Stats, bool) {
+	if a.spool == nil {
+		return spool.Stats{}, false
+	}
+
+	return a.spool.Stats(), true
+}
+
+// RunCron fires the cron jobs until ctx is cancelled.
+func (a *App) RunCron(ctx context.Context) error {
+	err := a.cron.Run(ctx)
+	if err != nil {
+		return errors.Wrap(err, "run cron")
+	}
+
+	return nil
+}
+
+// AddCronJob adds the periodic job in addition to the jobs from the config.
+func (a *App) AddCronJob(job cron.Job) error {
+	err := a.cron.AddJob(job)
+	if err != nil {
+		return errors.Wrap(err, "add cron job")
+	}
+
+	return nil
+}
+
+// RegisterHandler sets the handler of the event type in the default group,
+// handlers should be registered before the consumer is run.
+func (a *App) RegisterHandler(evt entity.EventType, f handler.Func) {
+	a.groups[0].handler.Register(evt, f)
+}
+
+// RegisterGroupHandler sets the handler of the event type in the given group of the queue.
+func (a *App) RegisterGroupHandler(group string, evt entity.EventType, f handler.Func) error {
+	g, err := a.group(group)
 	if err != nil {
-		return errors.Wrap(err, "produce message")
+		return errors.Wrap(err, "get group")
 	}
 
+	g.handler.Register(evt, f)
+
 	return nil
 }
 
+// RegisterHandler sets the handler of the event type in the default group which gets the payload decoded into T.
+func RegisterHandler[T any](a *App, evt entity.EventType, f handler.TypedFunc[T]) {
+	handler.RegisterHandler(a.groups[0].handler, evt, f)
+}
+
+// RegisterGroupHandler sets the handler of the event type in the given group which gets the payload decoded into T.
+func RegisterGroupHandler[T any](a *App, group string, evt entity.EventType, f handler.TypedFunc[T]) error {
+	g, err := a.group(group)
+	if err != nil {
+		return errors.Wrap(err, "get group")
+	}
+
+	handler.RegisterHandler(g.handler, evt, f)
+
+	return nil
+}
+
+// ProduceMsg sends the message and returns its stream id, a message with an idempotency key
+// produced again within the dedup window is not sent and the id of the first one is returned.
+// With the spool enabled, entity.ErrSpooled is returned for a message kept until redis is back.
+func (a *App) ProduceMsg(ctx context.Context, evt entity.EventType, message entity.Message) (string, error) {
+	id, err := a.producer.Produce(ctx, evt, message)
+	if err != nil {
+		return "", errors.Wrap(err, "produce message")
+	}
+
+	return id, nil
+}
+
+// ProduceBatch sends the messages in pipelines and returns the stream id or the error of every message,
+// the event types are taken from the messages.
+func (a *App) ProduceBatch(ctx context.Context, messages []entity.Message) []entity.ProduceResult {
+	return a.producer.ProduceBatch(ctx, messages)
+}
+
+// ProduceWithPriority sends the message to the stream of the priority and returns its stream id.
+func (a *App) ProduceWithPriority(ctx context.Context, evt entity.EventType, priority entity.Priority, message entity.Message) (string, error) {
+	id, err := a.producer.ProduceWithPriority(ctx, evt, priority, message)
+	if err != nil {
+		return "", errors.Wrap(err, "produce message with priority")
+	}
+
+	return id, nil
+}
+
+// ProduceAt schedules the message to be added to the queue at the given time and returns its id,
+// the scheduler must be running.
+func (a *App) ProduceAt(ctx context.Context, evt entity.EventType, message entity.Message, at time.Time) (string, error) {
+	id, err := a.producer.ProduceAt(ctx, evt, message, at)
+	if err != nil {
+		return "", errors.Wrap(err, "produce message at")
+	}
+
+	return id, nil
+}
+
+// ProduceAfter schedules the message to be added to the queue after the delay and returns its id,
+// the scheduler must be running.
+func (a *App) ProduceAfter(ctx context.Context, evt entity.EventType, message entity.Message, delay time.Duration) (string, error) {
+	id, err := a.producer.ProduceAfter(ctx, evt, message, delay)
+	if err != nil {
+		return "", errors.Wrap(err, "produce message after")
+	}
+
+	return id, nil
+}
+
+// CancelScheduled removes the scheduled message by its id, false is returned if it is not scheduled.
+func (a *App) CancelScheduled(ctx context.Context, id string) (bool, error) {
+	cancelled, err := a.producer.CancelScheduled(ctx, id)
+	if err != nil {
+		return false, errors.Wrap(err, "cancel scheduled message")
+	}
+
+	return cancelled, nil
+}
+
+// Reschedule changes the time of the scheduled message by its id, false is returned if it is not scheduled.
+func (a *App) Reschedule(ctx context.Context, id string, at time.Time) (bool, error) {
+	rescheduled, err := a.producer.Reschedule(ctx, id, at)
+	if err != nil {
+		return false, errors.Wrap(err, "reschedule message")
+	}
+
+	return rescheduled, nil
+}
+
+// Scheduled returns the scheduled message by its id, false is returned if it is not scheduled.
+func (a *App) Scheduled(ctx context.Context, id string) (entity.ScheduledMessage, bool, error) {
+	m, found, err := a.producer.Scheduled(ctx, id)
+	if err != nil {
+		return entity.ScheduledMessage{}, false, errors.Wrap(err, "get scheduled message")
+	}
+
+	return m, found, nil
+}
+
+// Produce sends the payload marshaled to json as a message of the event type.
+func Produce[T any](ctx context.Context, a *App, evt entity.EventType, payload T) error {
+	err := producer.Produce(ctx, a.producer, evt, payload)
+	if err != nil {
+		return errors.Wrap(err, "produce payload")
+	}
+
+	return nil
+}
+
+// ProduceOnce sends the payload like Produce unless a payload with the idempotency key
+// was sent within the dedup window.
+func ProduceOnce[T any](ctx context.Context, a *App, evt entity.EventType, idempotencyKey string, payload T) error {
+	err := producer.ProduceOnce(ctx, a.producer, evt, idempotencyKey, payload)
+	if err != nil {
+		return errors.Wrap(err, "produce payload once")
+	}
+
+	return nil
+}
+
+// DeadLetterMessages reads messages that were moved to the dead-letter queue of the group
+// starting from the given entry id.
+func (a *App) DeadLetterMessages(ctx context.Context, group string, start string, limit int) ([]entity.Message, error) {
+	messages, err := a.repo.DeadLetterMessages(ctx, entity.GetDeadLetterMessagesDTO{
+		Queue: a.config.Redis.Consumer.Queue,
+		Group: group,
+		Start: start,
+		Limit: limit,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "get dead letter messages")
+	}
+
+	return messages, nil
+}
+
+// WaitShutdown stops the queue components within the ctx deadline, closes the producer and the redis client
+// after them, it should be called once RunConsumer has returned.
 func (a *App) WaitShutdown(ctx context.Context) error {
+	defer a.redisClient.Close()
+
 	g, ctx := errgroup.WithContext(ctx)
 
 	for _, f := range a.queueShutDownFuncs {
 		f := f
 
 		g.Go(func() error {
-			if err := f(); err != nil {
+			if err := f(ctx); err != nil {
 				return errors.Wrap(err, "shutdown func")
 			}
 
@@ -119,6 +498,12 @@ func (a *App) WaitShutdown(ctx context.Context) error {
 	}
 
 	err := g.Wait()
+
+	// the producer is closed after the consumers, since their handlers may produce messages
+	if cerr := a.producer.Close(); cerr != nil {
+		return errors.Wrap(cerr, "close producer")
+	}
+
 	if err != nil {
 		return errors.Wrap(err, "wait shutdown funcs")
 	}
@@ -126,6 +511,6 @@ func (a *App) WaitShutdown(ctx context.Context) error {
 	return nil
 }
 
-func (a *App) registerShutdown(f func() error) {
+func (a *App) registerShutdown(f func(ctx context.Context) error) {
 	a.queueShutDownFuncs = append(a.queueShutDownFuncs, f)
 }
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"slices"
+
+	"github.com/pkg/errors"
+	"github.com/veleton777/redis_queue/internal/consumer"
+	"github.com/veleton777/redis_queue/internal/consumer/handler"
+	"github.com/veleton777/redis_queue/internal/entity"
+	"github.com/veleton777/redis_queue/internal/janitor"
+)
+
+// group is one consumer group of the queue with its own handlers, offsets and dead-letter queue.
+type group struct {
+	name     string
+	handler  *handler.Handler
+	consumer *consumer.Consumer
+	janitors []*janitor.Janitor
+}
+
+func (a *App) buildGroup(name string) (*group, error) {
+	switch expired := consumer.ExpiredAction(a.config.Redis.Consumer.ExpiredAction); expired {
+	case consumer.ExpiredDiscard, consumer.ExpiredDeadLetter:
+	default:
+		return nil, errors.Errorf("unknown expired action: %s", expired)
+	}
+
+	g := &group{
+		name:    name,
+		handler: handler.NewHandler(),
+	}
+
+	g.handler.SetLegacyType(entity.EventType(a.config.Redis.Consumer.LegacyEventType))
+
+	if name == a.config.Redis.Consumer.Group {
+		handler.RegisterHandler(g.handler, entity.EventTypeUser, handler.User)
+	}
+
+	g.consumer = consumer.New(consumer.Params{
+		Logger:  a.logger,
+		Repo:    a.repo,
+		Handler: g.handler,
+		Opts: consumer.Opts{
+			ID:                      a.consumerID,
+			TasksForIteration:       10,
+			Queue:                   a.config.Redis.Consumer.Queue,
+			Group:                   name,
+			CheckFailedMessagesTime: a.config.Redis.Consumer.IdleTimeForFailedTask,
+			IdleTimeForNewTask:      a.config.Redis.Consumer.IdleTimeForNewTask,
+			Concurrency:             a.config.Redis.Consumer.Concurrency,
+			MaxDeliveries:           a.config.Redis.Consumer.MaxDeliveries,
+			Backoff: consumer.Backoff{
+				Base:   a.config.Redis.Consumer.RetryBase,
+				Factor: a.config.Redis.Consumer.RetryFactor,
+				Max:    a.config.Redis.Consumer.RetryMax,
+				Jitter: a.config.Redis.Consumer.RetryJitter,
+			},
+			Streams: a.streams,
+			Order:   consumer.Order(a.config.Redis.Consumer.PriorityOrder),
+			Expired: consumer.ExpiredAction(a.config.Redis.Consumer.ExpiredAction),
+		},
+	})
+
+	for _, s := range a.streams {
+		g.janitors = append(g.janitors, janitor.New(janitor.Params{
+			Logger: a.logger,
+			Repo:   a.repo,
+			Locker: a.locker,
+			Opts: janitor.Opts{
+				Queue:      s.Queue,
+				Group:      name,
+				Interval:   a.config.Redis.Consumer.ReapInterval,
+				MaxIdle:    a.config.Redis.Consumer.ReapIdleTime,
+				ClaimLimit: 100,
+			},
+		}))
+	}
+
+	return g, nil
+}
+
+// groupNames returns the default group followed by the additional groups of the queue.
+func (a *App) groupNames() []string {
+	names := []string{a.config.Redis.Consumer.Group}
+
+	for _, name := range a.config.Redis.Consumer.Groups {
+		if name == "" || slices.Contains(names, name) {
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	return names
+}
+
+func (a *App) group(name string) (*group, error) {
+	for _, g := range a.groups {
+		if g.name == name {
+			return g, nil
+		}
+	}
+
+	return nil, errors.Errorf("unknown group: %s", name)
+}
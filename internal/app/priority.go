@@ -0,0 +1,53 @@
+package app
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/veleton777/redis_queue/internal/consumer"
+	"github.com/veleton777/redis_queue/internal/entity"
+	"github.com/veleton777/redis_queue/internal/repository/redis"
+)
+
+// buildStreams returns the priority streams of the queue in the order of the config and their priorities,
+// each priority is given as name or name:weight. Without priorities it is the queue itself.
+func (a *App) buildStreams() ([]consumer.Stream, []entity.Priority, error) {
+	queue := a.config.Redis.Consumer.Queue
+
+	switch order := consumer.Order(a.config.Redis.Consumer.PriorityOrder); order {
+	case consumer.OrderStrict, consumer.OrderWeighted:
+	default:
+		return nil, nil, errors.Errorf("unknown priority order: %s", order)
+	}
+
+	if len(a.config.Redis.Consumer.Priorities) == 0 {
+		return []consumer.Stream{{Queue: queue, Weight: 1}}, []entity.Priority{entity.PriorityNormal}, nil
+	}
+
+	streams := make([]consumer.Stream, 0, len(a.config.Redis.Consumer.Priorities))
+	priorities := make([]entity.Priority, 0, len(a.config.Redis.Consumer.Priorities))
+
+	for _, p := range a.config.Redis.Consumer.Priorities {
+		name, weight, hasWeight := strings.Cut(strings.TrimSpace(p), ":")
+
+		priority, err := entity.ParsePriority(name)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "parse priority")
+		}
+
+		s := consumer.Stream{Queue: redis.PriorityQueue(queue, priority), Weight: 1}
+
+		if hasWeight {
+			s.Weight, err = strconv.Atoi(weight)
+			if err != nil || s.Weight < 1 {
+				return nil, nil, errors.Errorf("invalid weight of priority %s: %s", name, weight)
+			}
+		}
+
+		streams = append(streams, s)
+		priorities = append(priorities, priority)
+	}
+
+	return streams, priorities, nil
+}
@@ -0,0 +1,119 @@
+package codec
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+// Headers written by the encoder, so a stream with messages of several codecs is decoded correctly.
+const (
+	HeaderCodec    = "codec"
+	HeaderEncoding = "content-encoding"
+)
+
+var (
+	ErrUnknownCodec       = errors.New("unknown codec")
+	ErrUnknownCompression = errors.New("unknown compression")
+)
+
+// Codec encodes the message as the data of its stream entry, the headers are not encoded.
+// The payload is kept as it is: typed payloads are json, see producer.Produce.
+type Codec interface {
+	Name() string
+	Marshal(m entity.Message) ([]byte, error)
+	Unmarshal(data []byte, m *entity.Message) error
+}
+
+// Get returns the codec by its name, an empty name is json.
+func Get(name string) (Codec, error) {
+	switch name {
+	case "", jsonName:
+		return JSON{}, nil
+	case msgpackName:
+		return MessagePack{}, nil
+	case protobufName:
+		return Protobuf{}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCodec, name)
+	}
+}
+
+// Encoder encodes messages of a queue by its codec and compresses the data bigger than the threshold.
+type Encoder struct {
+	Codec       Codec
+	Compression Compression
+	// Threshold is the min size of the data in bytes which is compressed.
+	Threshold int
+}
+
+// NewEncoder returns the encoder by the names of the codec and the compression.
+func NewEncoder(codec, compression string, threshold int) (Encoder, error) {
+	c, err := Get(codec)
+	if err != nil {
+		return Encoder{}, err
+	}
+
+	switch cmp := Compression(compression); cmp {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+		return Encoder{Codec: c, Compression: cmp, Threshold: threshold}, nil
+	default:
+		return Encoder{}, fmt.Errorf("%w: %s", ErrUnknownCompression, compression)
+	}
+}
+
+// Encode returns the data of the message and its headers with the codec and the compression recorded.
+func (e Encoder) Encode(m entity.Message) ([]byte, map[string]string, error) {
+	c := e.Codec
+	if c == nil {
+		c = JSON{}
+	}
+
+	data, err := c.Marshal(m)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "marshal %s", c.Name())
+	}
+
+	headers := make(map[string]string, len(m.Headers)+2)
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+
+	delete(headers, HeaderEncoding)
+	headers[HeaderCodec] = c.Name()
+
+	if e.Compression != CompressionNone && len(data) >= e.Threshold {
+		if data, err = compress(e.Compression, data); err != nil {
+			return nil, nil, errors.Wrapf(err, "compress %s", e.Compression)
+		}
+
+		headers[HeaderEncoding] = string(e.Compression)
+	}
+
+	return data, headers, nil
+}
+
+// Decode returns the message from the data by the codec and the compression in its headers,
+// entries without the codec header are json.
+func Decode(data []byte, headers map[string]string) (entity.Message, error) {
+	c, err := Get(headers[HeaderCodec])
+	if err != nil {
+		return entity.Message{}, err
+	}
+
+	if enc := headers[HeaderEncoding]; enc != "" {
+		if data, err = decompress(Compression(enc), data); err != nil {
+			return entity.Message{}, errors.Wrapf(err, "decompress %s", enc)
+		}
+	}
+
+	var m entity.Message
+	if err = c.Unmarshal(data, &m); err != nil {
+		return entity.Message{}, errors.Wrapf(err, "unmarshal %s", c.Name())
+	}
+
+	m.Headers = headers
+
+	return m, nil
+}
@@ -0,0 +1,182 @@
+package codec
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+// fullMessage has every encoded field of the message set.
+func fullMessage() entity.Message {
+	expiresAt := time.UnixMilli(1700000000123)
+
+	return entity.Message{
+		ID:             "1700000000000-0",
+		Type:           entity.EventTypeUser,
+		Payload:        `{"id":"1","name":"` + strings.Repeat("a", 2048) + `"}`,
+		Attempt:        3,
+		RetryGroup:     "group",
+		Priority:       entity.PriorityHigh,
+		IdempotencyKey: "key",
+		ExpiresAt:      &expiresAt,
+		Headers:        map[string]string{"trace-id": "abc"},
+		ClaimCheck:     "queue:blob:1",
+		OriginID:       "1690000000000-0",
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, codec := range []string{"json", "msgpack", "protobuf"} {
+		for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+			t.Run(codec+"/"+string(compression), func(t *testing.T) {
+				enc, err := NewEncoder(codec, string(compression), 1024)
+				if err != nil {
+					t.Fatalf("new encoder: %v", err)
+				}
+
+				want := fullMessage()
+
+				data, headers, err := enc.Encode(want)
+				if err != nil {
+					t.Fatalf("encode: %v", err)
+				}
+
+				if headers[HeaderCodec] != codec || headers[HeaderEncoding] != string(compression) {
+					t.Fatalf("headers %v do not record %s and %s", headers, codec, compression)
+				}
+
+				got, err := Decode(data, headers)
+				if err != nil {
+					t.Fatalf("decode: %v", err)
+				}
+
+				assertMessage(t, got, want)
+			})
+		}
+	}
+}
+
+func assertMessage(t *testing.T, got, want entity.Message) {
+	t.Helper()
+
+	if got.ExpiresAt == nil || !got.ExpiresAt.Equal(*want.ExpiresAt) {
+		t.Fatalf("expires at: got %v, want %v", got.ExpiresAt, want.ExpiresAt)
+	}
+
+	got.ExpiresAt, want.ExpiresAt = nil, nil
+
+	for k, v := range want.Headers {
+		if got.Headers[k] != v {
+			t.Fatalf("header %s: got %q, want %q", k, got.Headers[k], v)
+		}
+	}
+
+	got.Headers, want.Headers = nil, nil
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestProtobufNegativeVarints(t *testing.T) {
+	expiresAt := time.UnixMilli(-1000)
+	want := entity.Message{ID: "1", Type: -1, Attempt: -5, ExpiresAt: &expiresAt}
+
+	data, err := Protobuf{}.Marshal(want)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	var got entity.Message
+	if err = (Protobuf{}).Unmarshal(data, &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	assertMessage(t, got, want)
+}
+
+func TestProtobufTruncated(t *testing.T) {
+	data, err := Protobuf{}.Marshal(fullMessage())
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	// every prefix either ends at a field boundary or is malformed, it never panics
+	for i := range data {
+		var m entity.Message
+		_ = Protobuf{}.Unmarshal(data[:i], &m)
+	}
+
+	// the payload is cut in the middle
+	var m entity.Message
+	if err = (Protobuf{}).Unmarshal(data[:len(data)/2], &m); !errors.Is(err, errMalformed) {
+		t.Fatalf("unmarshal truncated envelope: got %v, want errMalformed", err)
+	}
+
+	// the key of a field without its value
+	if err = (Protobuf{}).Unmarshal([]byte{fieldAttempt<<3 | wireVarint}, &m); !errors.Is(err, errMalformed) {
+		t.Fatalf("unmarshal field without value: got %v, want errMalformed", err)
+	}
+}
+
+func TestProtobufUnknownFields(t *testing.T) {
+	want := fullMessage()
+
+	data, err := Protobuf{}.Marshal(want)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	// fields of a newer envelope of every wire type but groups
+	data = appendVarint(data, 100, 42)
+	data = appendString(data, 101, "unknown")
+	data = binary.AppendUvarint(data, 102<<3|wireFixed64)
+	data = append(data, 1, 2, 3, 4, 5, 6, 7, 8)
+	data = binary.AppendUvarint(data, 103<<3|wireFixed32)
+	data = append(data, 1, 2, 3, 4)
+
+	var got entity.Message
+	if err = (Protobuf{}).Unmarshal(data, &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	got.Headers = want.Headers
+
+	assertMessage(t, got, want)
+}
+
+func TestDecompressLimit(t *testing.T) {
+	bomb := make([]byte, maxDecompressedSize+1)
+
+	for _, c := range []Compression{CompressionGzip, CompressionZstd} {
+		data, err := compress(c, bomb)
+		if err != nil {
+			t.Fatalf("compress %s: %v", c, err)
+		}
+
+		if _, err = decompress(c, data); !errors.Is(err, ErrTooLarge) {
+			t.Fatalf("decompress %s of %d bytes: got %v, want ErrTooLarge", c, len(bomb), err)
+		}
+	}
+}
+
+func TestDecodeUnknown(t *testing.T) {
+	if _, err := Decode([]byte("{}"), map[string]string{HeaderCodec: "xml"}); !errors.Is(err, ErrUnknownCodec) {
+		t.Fatalf("decode unknown codec: got %v, want ErrUnknownCodec", err)
+	}
+
+	if _, err := Decode([]byte("{}"), map[string]string{HeaderEncoding: "lz4"}); !errors.Is(err, ErrUnknownCompression) {
+		t.Fatalf("decode unknown compression: got %v, want ErrUnknownCompression", err)
+	}
+
+	// entries produced before codecs were added have no headers
+	m, err := Decode([]byte(`{"id":"1","type":1,"payload":"p"}`), nil)
+	if err != nil || m.ID != "1" || m.Payload != "p" {
+		t.Fatalf("decode legacy json: %v, %+v", err, m)
+	}
+}
@@ -0,0 +1,99 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Compression is the algorithm the data of big messages is compressed with.
+type Compression string
+
+const (
+	CompressionNone Compression = ""
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// maxDecompressedSize bounds the decompressed data, so a small entry can't expand into gigabytes.
+const maxDecompressedSize = 64 << 20
+
+// ErrTooLarge is returned for compressed data bigger than maxDecompressedSize after decompression.
+var ErrTooLarge = errors.New("decompressed data is too large")
+
+// zstd encoders and decoders are safe for concurrent use and expensive to create, so they are shared.
+var (
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func init() {
+	var err error
+
+	if zstdEncoder, err = zstd.NewWriter(nil); err != nil {
+		panic(errors.Wrap(err, "create zstd encoder"))
+	}
+
+	if zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize)); err != nil {
+		panic(errors.Wrap(err, "create zstd decoder"))
+	}
+}
+
+func compress(c Compression, data []byte) ([]byte, error) {
+	switch c {
+	case CompressionGzip:
+		var buf bytes.Buffer
+
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCompression, c)
+	}
+}
+
+func decompress(c Compression, data []byte) ([]byte, error) {
+	switch c {
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+
+		defer r.Close()
+
+		b, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(b) > maxDecompressedSize {
+			return nil, ErrTooLarge
+		}
+
+		return b, nil
+	case CompressionZstd:
+		b, err := zstdDecoder.DecodeAll(data, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) ||
+			errors.Is(err, zstd.ErrFrameSizeExceeded) {
+			return nil, fmt.Errorf("%w: %w", ErrTooLarge, err)
+		}
+
+		return b, err
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCompression, c)
+	}
+}
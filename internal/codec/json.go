@@ -0,0 +1,24 @@
+package codec
+
+import (
+	"encoding/json"
+
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+const jsonName = "json"
+
+// JSON is the codec of the messages produced before codecs were added.
+type JSON struct{}
+
+func (JSON) Name() string {
+	return jsonName
+}
+
+func (JSON) Marshal(m entity.Message) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func (JSON) Unmarshal(data []byte, m *entity.Message) error {
+	return json.Unmarshal(data, m)
+}
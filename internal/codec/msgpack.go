@@ -0,0 +1,38 @@
+package codec
+
+import (
+	"bytes"
+
+	"github.com/veleton777/redis_queue/internal/entity"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const msgpackName = "msgpack"
+
+// MessagePack encodes the message with the field names of its json.
+type MessagePack struct{}
+
+func (MessagePack) Name() string {
+	return msgpackName
+}
+
+func (MessagePack) Marshal(m entity.Message) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.SetOmitEmpty(true)
+
+	if err := enc.Encode(m); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (MessagePack) Unmarshal(data []byte, m *entity.Message) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+
+	return dec.Decode(m)
+}
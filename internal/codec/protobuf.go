@@ -0,0 +1,176 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+const protobufName = "protobuf"
+
+// Protobuf encodes the message in the protobuf wire format of the envelope below,
+// the payload is kept as raw bytes, e.g. a protobuf message produced by the caller.
+//
+//	message Envelope {
+//	  string id = 1;
+//	  int64 type = 2;
+//	  bytes payload = 3;
+//	  int64 attempt = 4;
+//	  string retry_group = 5;
+//	  string priority = 6;
+//	  string idempotency_key = 7;
+//	  int64 expires_at_unix_ms = 8;
+//	  string claim_check = 9;
+//	  string origin_id = 10;
+//	}
+type Protobuf struct{}
+
+const (
+	fieldID = iota + 1
+	fieldType
+	fieldPayload
+	fieldAttempt
+	fieldRetryGroup
+	fieldPriority
+	fieldIdempotencyKey
+	fieldExpiresAt
+	fieldClaimCheck
+	fieldOriginID
+)
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errMalformed = errors.New("malformed protobuf envelope")
+
+func (Protobuf) Name() string {
+	return protobufName
+}
+
+func (Protobuf) Marshal(m entity.Message) ([]byte, error) {
+	var b []byte
+
+	b = appendString(b, fieldID, m.ID)
+	b = appendVarint(b, fieldType, int64(m.Type))
+	b = appendString(b, fieldPayload, m.Payload)
+	b = appendVarint(b, fieldAttempt, m.Attempt)
+	b = appendString(b, fieldRetryGroup, m.RetryGroup)
+	b = appendString(b, fieldPriority, string(m.Priority))
+	b = appendString(b, fieldIdempotencyKey, m.IdempotencyKey)
+
+	if m.ExpiresAt != nil {
+		b = appendVarint(b, fieldExpiresAt, m.ExpiresAt.UnixMilli())
+	}
+
+	b = appendString(b, fieldClaimCheck, m.ClaimCheck)
+	b = appendString(b, fieldOriginID, m.OriginID)
+
+	return b, nil
+}
+
+func (Protobuf) Unmarshal(data []byte, m *entity.Message) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errMalformed
+		}
+
+		data = data[n:]
+		field, wire := key>>3, key&7
+
+		switch wire {
+		case wireVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errMalformed
+			}
+
+			data = data[n:]
+			setVarint(m, field, int64(v))
+		case wireBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return errMalformed
+			}
+
+			setString(m, field, string(data[n:n+int(l)]))
+			data = data[n+int(l):]
+		case wireFixed64, wireFixed32:
+			// the envelope has no fixed fields, they are unknown fields of a newer envelope and are skipped
+			size := 8
+			if wire == wireFixed32 {
+				size = 4
+			}
+
+			if len(data) < size {
+				return errMalformed
+			}
+
+			data = data[size:]
+		default:
+			return fmt.Errorf("%w: wire type %d", errMalformed, wire)
+		}
+	}
+
+	return nil
+}
+
+func setVarint(m *entity.Message, field uint64, v int64) {
+	switch field {
+	case fieldType:
+		m.Type = entity.EventType(v)
+	case fieldAttempt:
+		m.Attempt = v
+	case fieldExpiresAt:
+		t := time.UnixMilli(v)
+		m.ExpiresAt = &t
+	}
+}
+
+func setString(m *entity.Message, field uint64, v string) {
+	switch field {
+	case fieldID:
+		m.ID = v
+	case fieldPayload:
+		m.Payload = v
+	case fieldRetryGroup:
+		m.RetryGroup = v
+	case fieldPriority:
+		m.Priority = entity.Priority(v)
+	case fieldIdempotencyKey:
+		m.IdempotencyKey = v
+	case fieldClaimCheck:
+		m.ClaimCheck = v
+	case fieldOriginID:
+		m.OriginID = v
+	}
+}
+
+// appendVarint skips zero values like proto3 does.
+func appendVarint(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireVarint)
+
+	return binary.AppendUvarint(b, uint64(v))
+}
+
+func appendString(b []byte, field int, v string) []byte {
+	if v == "" {
+		return b
+	}
+
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+
+	return append(b, v...)
+}
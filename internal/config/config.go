@@ -1,6 +1,7 @@
 package config
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/pkg/errors"
@@ -17,14 +18,144 @@ type Redis struct {
 	Password string `env:"REDIS_PASSWORD"`
 	DB       int    `env:"REDIS_DB" env-default:"0"`
 
-	Consumer RedisConsumer
+	Consumer  RedisConsumer
+	Producer  RedisProducer
+	Retention RedisRetention
+	Scheduler RedisScheduler
+	Cron      RedisCron
+	Lock      RedisLock
+	Spool     RedisSpool
 }
 
 type RedisConsumer struct {
-	Queue                 string        `env:"REDIS_CONSUMER_QUEUE" env-default:"default_queue"`
-	Group                 string        `env:"REDIS_CONSUMER_GROUP" env-default:"default_group"`
+	Queue string `env:"REDIS_CONSUMER_QUEUE" env-default:"default_queue"`
+	Group string `env:"REDIS_CONSUMER_GROUP" env-default:"default_group"`
+	// Groups are additional consumer groups of the queue, each of them receives every message.
+	Groups                []string      `env:"REDIS_CONSUMER_GROUPS" env-separator:","`
 	IdleTimeForFailedTask time.Duration `env:"REDIS_CONSUMER_IDLE_TIME_FOR_FAILED_TASK" env-default:"30s"`
 	IdleTimeForNewTask    time.Duration `env:"REDIS_CONSUMER_IDLE_TIME_FOR_NEW_TASK" env-default:"10s"`
+	Concurrency           int           `env:"REDIS_CONSUMER_CONCURRENCY" env-default:"1"`
+	MaxDeliveries         int64         `env:"REDIS_CONSUMER_MAX_DELIVERIES" env-default:"5"`
+	ShutdownTimeout       time.Duration `env:"REDIS_CONSUMER_SHUTDOWN_TIMEOUT" env-default:"30s"`
+	// LegacyEventType is the type of messages produced without one, zero sends them to the dead-letter queue.
+	LegacyEventType int `env:"REDIS_CONSUMER_LEGACY_EVENT_TYPE" env-default:"1"`
+	// Priorities are read from the first one, e.g. high:4,normal:2,low:1 where the weights
+	// are used by the weighted order. Empty means the queue has only the normal priority.
+	Priorities    []string `env:"REDIS_CONSUMER_PRIORITIES" env-separator:","`
+	PriorityOrder string   `env:"REDIS_CONSUMER_PRIORITY_ORDER" env-default:"strict"`
+	// ExpiredAction is discard or deadletter.
+	ExpiredAction string `env:"REDIS_CONSUMER_EXPIRED_ACTION" env-default:"discard"`
+	// RetryBase of zero disables retries through the delayed queue, they need the scheduler to be running.
+	RetryBase   time.Duration `env:"REDIS_CONSUMER_RETRY_BASE" env-default:"0s"`
+	RetryFactor float64       `env:"REDIS_CONSUMER_RETRY_FACTOR" env-default:"2"`
+	RetryMax    time.Duration `env:"REDIS_CONSUMER_RETRY_MAX" env-default:"10m"`
+	// RetryJitter is clamped to [0, 1].
+	RetryJitter  float64       `env:"REDIS_CONSUMER_RETRY_JITTER" env-default:"0.2"`
+	ReapIdleTime time.Duration `env:"REDIS_CONSUMER_REAP_IDLE_TIME" env-default:"1h"`
+	ReapInterval time.Duration `env:"REDIS_CONSUMER_REAP_INTERVAL" env-default:"1m"`
+}
+
+type RedisProducer struct {
+	// DedupWindow is how long idempotency keys of produced messages are kept.
+	DedupWindow  time.Duration `env:"REDIS_PRODUCER_DEDUP_WINDOW" env-default:"24h"`
+	MaxBatchSize int           `env:"REDIS_PRODUCER_MAX_BATCH_SIZE" env-default:"1000"`
+	// CapMode is empty, maxlen, minid or reject, maxlen and reject use CapMaxLen and minid uses CapMaxAge.
+	CapMode   string        `env:"REDIS_PRODUCER_CAP_MODE"`
+	CapMaxLen int64         `env:"REDIS_PRODUCER_CAP_MAX_LEN" env-default:"1000000"`
+	CapMaxAge time.Duration `env:"REDIS_PRODUCER_CAP_MAX_AGE" env-default:"24h"`
+	// Codec of the queue is json, msgpack or protobuf, Compression is empty, gzip or zstd
+	// and is applied to messages of at least CompressThreshold bytes. Typed payloads are json with any codec.
+	Codec             string `env:"REDIS_PRODUCER_CODEC" env-default:"json"`
+	Compression       string `env:"REDIS_PRODUCER_COMPRESSION"`
+	CompressThreshold int    `env:"REDIS_PRODUCER_COMPRESS_THRESHOLD" env-default:"1024"`
+	// Payloads longer than ClaimCheckThreshold bytes are kept out of the stream for ClaimCheckTTL,
+	// zero threshold disables offloading.
+	ClaimCheckThreshold int           `env:"REDIS_PRODUCER_CLAIM_CHECK_THRESHOLD" env-default:"1048576"`
+	ClaimCheckTTL       time.Duration `env:"REDIS_PRODUCER_CLAIM_CHECK_TTL" env-default:"168h"`
+}
+
+type RedisRetention struct {
+	// Policy is one of none, maxlen, maxage or groups.
+	Policy   string        `env:"REDIS_RETENTION_POLICY" env-default:"groups"`
+	MaxLen   int64         `env:"REDIS_RETENTION_MAX_LEN" env-default:"100000"`
+	MaxAge   time.Duration `env:"REDIS_RETENTION_MAX_AGE" env-default:"24h"`
+	Interval time.Duration `env:"REDIS_RETENTION_INTERVAL" env-default:"1m"`
+}
+
+type RedisScheduler struct {
+	Interval  time.Duration `env:"REDIS_SCHEDULER_INTERVAL" env-default:"1s"`
+	BatchSize int           `env:"REDIS_SCHEDULER_BATCH_SIZE" env-default:"100"`
+}
+
+type RedisCron struct {
+	Interval   time.Duration `env:"REDIS_CRON_INTERVAL" env-default:"1s"`
+	MaxCatchUp int           `env:"REDIS_CRON_MAX_CATCH_UP" env-default:"10"`
+	Jobs       CronJobs      `env:"REDIS_CRON_JOBS"`
+}
+
+type RedisLock struct {
+	TTL           time.Duration `env:"REDIS_LOCK_TTL" env-default:"30s"`
+	RetryInterval time.Duration `env:"REDIS_LOCK_RETRY_INTERVAL" env-default:"100ms"`
+}
+
+// RedisSpool is disabled if Dir is empty.
+type RedisSpool struct {
+	Dir      string        `env:"REDIS_SPOOL_DIR"`
+	MaxSize  int64         `env:"REDIS_SPOOL_MAX_SIZE" env-default:"104857600"`
+	Interval time.Duration `env:"REDIS_SPOOL_INTERVAL" env-default:"5s"`
+}
+
+type CronJob struct {
+	Name     string
+	Every    time.Duration
+	Queue    string
+	Priority string
+	Type     int
+	Payload  string
+	Missed   string
+}
+
+// CronJobs is read from a json array, e.g.
+// [{"name": "cleanup", "every": "5m", "queue": "x", "priority": "high", "type": 1, "payload": "{}", "missed": "skip"}].
+type CronJobs []CronJob
+
+func (j *CronJobs) SetValue(s string) error {
+	var raw []struct {
+		Name     string `json:"name"`
+		Every    string `json:"every"`
+		Queue    string `json:"queue"`
+		Priority string `json:"priority"`
+		Type     int    `json:"type"`
+		Payload  string `json:"payload"`
+		Missed   string `json:"missed"`
+	}
+
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return errors.Wrap(err, "json unmarshal cron jobs")
+	}
+
+	jobs := make(CronJobs, 0, len(raw))
+
+	for _, r := range raw {
+		every, err := time.ParseDuration(r.Every)
+		if err != nil {
+			return errors.Wrapf(err, "parse period of cron job %s", r.Name)
+		}
+
+		jobs = append(jobs, CronJob{
+			Name:     r.Name,
+			Every:    every,
+			Queue:    r.Queue,
+			Priority: r.Priority,
+			Type:     r.Type,
+			Payload:  r.Payload,
+			Missed:   r.Missed,
+		})
+	}
+
+	*j = jobs
+
+	return nil
 }
 
 func LoadFromEnv() (Config, error) {
@@ -34,5 +165,8 @@ func LoadFromEnv() (Config, error) {
 		return Config{}, errors.Wrap(err, "read env")
 	}
 
+	// a jitter out of [0, 1] would make retry delays negative
+	config.Redis.Consumer.RetryJitter = min(max(config.Redis.Consumer.RetryJitter, 0), 1)
+
 	return config, nil
 }
@@ -0,0 +1,58 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+// loadPayloads fetches the payloads offloaded by claim-check before the messages are handled.
+// Messages whose payload expired are moved to the dead-letter queue, on error all messages stay pending.
+func (c *Consumer) loadPayloads(ctx context.Context, messages []entity.Message) []entity.Message {
+	own := make([]entity.Message, 0, len(messages))
+	rest := make([]entity.Message, 0, len(messages))
+
+	for _, m := range messages {
+		if m.ClaimCheck != "" && c.owns(m) {
+			own = append(own, m)
+			continue
+		}
+
+		rest = append(rest, m)
+	}
+
+	if len(own) == 0 {
+		return messages
+	}
+
+	if err := c.repo.LoadPayloads(ctx, own); err != nil {
+		c.logger.Err(fmt.Sprintf("load claim-check payloads: %v\n", err))
+		return nil
+	}
+
+	for _, m := range own {
+		if m.Payload == "" {
+			c.deadLetter(ctx, m, "claim-check payload expired")
+			continue
+		}
+
+		rest = append(rest, m)
+	}
+
+	return rest
+}
+
+// ack acks the message in the group, the payload offloaded by claim-check is released with it.
+func (c *Consumer) ack(ctx context.Context, m entity.Message) error {
+	if m.ClaimCheck == "" || !c.owns(m) {
+		return c.repo.AckMessages(ctx, m.Queue, c.opts.Group, []string{m.ID})
+	}
+
+	return c.repo.AckClaimCheck(ctx, c.opts.Group, m)
+}
+
+// owns reports whether the message is handled by the group, retries of other groups are only acked.
+func (c *Consumer) owns(m entity.Message) bool {
+	return m.RetryGroup == "" || m.RetryGroup == c.opts.Group
+}
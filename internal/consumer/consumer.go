@@ -3,6 +3,8 @@ package consumer
 import (
 	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -11,15 +13,26 @@ import (
 	"github.com/veleton777/redis_queue/internal/logger"
 )
 
+// retryDelay is the pause before the next read after redis returned an error.
+const retryDelay = time.Second
+
 type repo interface {
 	Messages(ctx context.Context, dto entity.GetMessagesDTO) ([]entity.Message, error)
 	FailedMessages(ctx context.Context, dto entity.GetFailedMessagesDTO) ([]entity.Message, error)
-	AckMessages(ctx context.Context, queue string, ids []string) error
+	AckMessages(ctx context.Context, queue, group string, ids []string) error
+	SaveMessageError(ctx context.Context, dto entity.SaveMessageErrorDTO) error
+	DeadLetterMessage(ctx context.Context, dto entity.DeadLetterMessageDTO) error
+	RetryMessage(ctx context.Context, dto entity.RetryMessageDTO) (bool, error)
 	RegisterConsumer(ctx context.Context, queue, group, consumerID string) error
+	Consumers(ctx context.Context, queue, group string) ([]entity.ConsumerInfo, error)
+	ClaimPending(ctx context.Context, dto entity.ClaimPendingDTO) (entity.ClaimPendingResult, error)
+	RemoveConsumer(ctx context.Context, queue, group, consumerID string) error
+	LoadPayloads(ctx context.Context, messages []entity.Message) error
+	AckClaimCheck(ctx context.Context, group string, m entity.Message) error
 }
 
 type handlerSrv interface {
-	Handle(ctx context.Context, evt handler.EventType, m entity.Message) error
+	Handle(ctx context.Context, m entity.Message) error
 }
 
 type Consumer struct {
@@ -27,6 +40,16 @@ type Consumer struct {
 	repo    repo
 	handler handlerSrv
 	opts    Opts
+
+	// workers limits the number of messages handled at the same time
+	workers chan struct{}
+	// inFlight counts messages taken by workers, Shutdown waits for them
+	inFlight sync.WaitGroup
+	// workCtx is given to handlers instead of the ctx of Run, so cancelling Run only stops fetching
+	// and the in-flight messages are interrupted by Shutdown when its deadline is exceeded
+	workCtx    context.Context
+	cancelWork context.CancelFunc
+	registered atomic.Bool
 }
 
 type Params struct {
@@ -44,100 +67,290 @@ type Opts struct {
 	Group                   string
 	CheckFailedMessagesTime time.Duration
 	IdleTimeForNewTask      time.Duration
+	// Concurrency is the max number of messages handled at the same time.
+	Concurrency int
+	// MaxDeliveries is how many times a message is delivered before it is moved to the dead-letter queue,
+	// zero means the message is retried forever.
+	MaxDeliveries int64
+	// Backoff is the policy of retries of failed messages through the delayed queue,
+	// the scheduler of the queue must be running for them.
+	Backoff Backoff
+	// Streams are the priority streams of the queue from the highest priority, by default it is the queue itself.
+	Streams []Stream
+	Order   Order
+	// Expired is applied to expired messages instead of handling them, by default they are discarded.
+	Expired ExpiredAction
 }
 
 func New(params Params) *Consumer {
+	if params.Opts.Concurrency < 1 {
+		params.Opts.Concurrency = 1
+	}
+
+	if params.Opts.Expired == "" {
+		params.Opts.Expired = ExpiredDiscard
+	}
+
+	if len(params.Opts.Streams) == 0 {
+		params.Opts.Streams = []Stream{{Queue: params.Opts.Queue, Weight: 1}}
+	}
+
+	for i := range params.Opts.Streams {
+		if params.Opts.Streams[i].Weight < 1 {
+			params.Opts.Streams[i].Weight = 1
+		}
+	}
+
+	workCtx, cancelWork := context.WithCancel(context.Background())
+
 	return &Consumer{
-		logger:  params.Logger,
-		repo:    params.Repo,
-		handler: params.Handler,
-		opts:    params.Opts,
+		logger:     params.Logger,
+		repo:       params.Repo,
+		handler:    params.Handler,
+		opts:       params.Opts,
+		workers:    make(chan struct{}, params.Opts.Concurrency),
+		workCtx:    workCtx,
+		cancelWork: cancelWork,
 	}
 }
 
+// Run consumes messages until ctx is cancelled. It returns as soon as fetching is stopped,
+// the messages that are still handled are waited for by Shutdown.
 func (c *Consumer) Run(ctx context.Context) error {
-	err := c.repo.RegisterConsumer(ctx, c.opts.Queue, c.opts.Group, c.opts.ID)
-	if err != nil {
-		return errors.Wrap(err, "register consumer")
+	for _, s := range c.opts.Streams {
+		err := c.repo.RegisterConsumer(ctx, s.Queue, c.opts.Group, c.opts.ID)
+		if err != nil {
+			return errors.Wrapf(err, "register consumer in %s", s.Queue)
+		}
 	}
 
-	if err = c.consumeMessages(ctx); err != nil {
-		return errors.Wrap(err, "consume messages")
-	}
+	c.registered.Store(true)
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		c.consumeMessages(ctx)
+	}()
+
+	go func() {
+		defer wg.Done()
+		c.consumeFailedMessages(ctx)
+	}()
+
+	wg.Wait()
 
 	return nil
 }
 
-func (c *Consumer) consumeMessages(ctx context.Context) error {
+// consumeMessages reads new messages back-to-back while there are any. When the queue is empty
+// XREADGROUP blocks for IdleTimeForNewTask, so a new message is picked up as soon as it is added.
+func (c *Consumer) consumeMessages(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := c.executeMessages(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			c.logger.Err(fmt.Sprintf("get messages: %v\n", err))
+			sleep(ctx, retryDelay)
+		}
+	}
+}
+
+// consumeFailedMessages reclaims messages that stayed pending for CheckFailedMessagesTime.
+func (c *Consumer) consumeFailedMessages(ctx context.Context) {
 	ticker := time.NewTicker(c.opts.CheckFailedMessagesTime)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
-			return nil
+			return
 		case <-ticker.C:
 			c.executeFailedMessages(ctx)
-		default:
-			c.executeMessages(ctx)
 		}
-
-		time.Sleep(1 * time.Second)
 	}
 }
 
-func (c *Consumer) executeMessages(ctx context.Context) {
+// executeMessages takes messages of the first stream in the read order that has any.
+// If all streams are empty it blocks on all of them at once.
+func (c *Consumer) executeMessages(ctx context.Context) error {
+	if len(c.opts.Streams) > 1 {
+		for _, queue := range c.readOrder() {
+			messages, err := c.repo.Messages(ctx, entity.GetMessagesDTO{
+				ConsumerID:      c.opts.ID,
+				Queues:          []string{queue},
+				Group:           c.opts.Group,
+				Limit:           c.opts.TasksForIteration,
+				DeadLetterQueue: c.opts.Queue,
+			})
+			if err != nil {
+				return errors.Wrapf(err, "get messages of %s", queue)
+			}
+
+			if len(messages) > 0 {
+				c.execute(ctx, messages)
+				return nil
+			}
+		}
+	}
+
 	messages, err := c.repo.Messages(ctx, entity.GetMessagesDTO{
-		ConsumerID: c.opts.ID,
-		BlockTime:  c.opts.IdleTimeForNewTask,
-		Queue:      c.opts.Queue,
-		Group:      c.opts.Group,
-		Limit:      c.opts.TasksForIteration,
+		ConsumerID:      c.opts.ID,
+		BlockTime:       c.opts.IdleTimeForNewTask,
+		Queues:          c.queues(),
+		Group:           c.opts.Group,
+		Limit:           c.opts.TasksForIteration,
+		DeadLetterQueue: c.opts.Queue,
 	})
 	if err != nil {
-		c.logger.Err(fmt.Sprintf("get messages: %v\n", err))
-		return
+		return errors.Wrap(err, "get messages")
 	}
 
 	c.execute(ctx, messages)
+
+	return nil
 }
 
+// execute passes the messages to the worker pool shared by new and reclaimed messages,
+// it blocks while all workers are busy. Messages that are not taken before ctx is cancelled
+// stay pending and are handed over to another consumer on shutdown. Expired messages never reach the handler,
+// the payloads offloaded by claim-check are loaded before it.
 func (c *Consumer) execute(ctx context.Context, messages []entity.Message) {
-	ids := make([]string, 0, len(messages))
-
-	for _, m := range messages {
-		if err := c.handler.Handle(ctx, 1, m); err != nil { // todo edit
-			c.logger.Err(fmt.Sprintf("handle message: %v\n", err))
+	for _, m := range c.loadPayloads(ctx, c.dropExpired(ctx, messages)) {
+		select {
+		case <-ctx.Done():
 			return
+		case c.workers <- struct{}{}:
 		}
-		ids = append(ids, m.ID)
+
+		c.inFlight.Add(1)
+
+		go func(m entity.Message) {
+			defer func() {
+				<-c.workers
+				c.inFlight.Done()
+			}()
+
+			c.executeMessage(c.workCtx, m)
+		}(m)
 	}
+}
+
+// executeMessage handles one message and records its outcome: the message is acked on success,
+// on failure it is rescheduled by the backoff policy or, if there is no policy, it stays pending
+// in the group with the error saved until it is claimed again.
+func (c *Consumer) executeMessage(ctx context.Context, m entity.Message) {
+	if !c.owns(m) {
+		if err := c.repo.AckMessages(ctx, m.Queue, c.opts.Group, []string{m.ID}); err != nil {
+			c.logger.Err(fmt.Sprintf("ack retry of group %s %s: %v\n", m.RetryGroup, m.ID, err))
+		}
 
-	if len(ids) == 0 {
 		return
 	}
 
-	if err := c.repo.AckMessages(ctx, c.opts.Queue, ids); err != nil {
-		c.logger.Err(fmt.Sprintf("ack messages: %v\n", err))
+	if err := c.handler.Handle(ctx, m); err != nil {
+		c.logger.Err(fmt.Sprintf("handle message %s: %v\n", m.ID, err))
+
+		if handler.IsNonRetryable(err) {
+			c.deadLetter(ctx, m, err.Error())
+			return
+		}
+
+		if c.opts.Backoff.enabled() {
+			c.retry(ctx, m, err)
+			return
+		}
+
+		err = c.repo.SaveMessageError(ctx, entity.SaveMessageErrorDTO{
+			Queue: m.Queue,
+			Group: c.opts.Group,
+			ID:    m.ID,
+			Err:   err.Error(),
+		})
+		if err != nil {
+			c.logger.Err(fmt.Sprintf("save message error: %v\n", err))
+		}
+
+		return
 	}
 
-	for _, id := range ids {
-		c.logger.Success(fmt.Sprintf("msg #: %s", id))
+	if err := c.ack(ctx, m); err != nil {
+		c.logger.Err(fmt.Sprintf("ack message %s: %v\n", m.ID, err))
+		return
 	}
+
+	c.logger.Success(fmt.Sprintf("msg #: %s", m.ID))
 }
 
 func (c *Consumer) executeFailedMessages(ctx context.Context) {
+	for _, s := range c.opts.Streams {
+		c.executeFailedMessagesOf(ctx, s.Queue)
+	}
+}
+
+func (c *Consumer) executeFailedMessagesOf(ctx context.Context, queue string) {
 	messages, err := c.repo.FailedMessages(ctx, entity.GetFailedMessagesDTO{
 		ConsumerID:         c.opts.ID,
-		Queue:              c.opts.Queue,
+		Queue:              queue,
 		Group:              c.opts.Group,
 		Limit:              c.opts.TasksForIteration,
 		IdleTimeForMessage: c.opts.CheckFailedMessagesTime,
+		DeadLetterQueue:    c.opts.Queue,
 	})
 	if err != nil {
-		c.logger.Err(fmt.Sprintf("get failed messages: %v\n", err))
+		c.logger.Err(fmt.Sprintf("get failed messages of %s: %v\n", queue, err))
 		return
 	}
 
-	c.execute(ctx, messages)
+	retries := make([]entity.Message, 0, len(messages))
+
+	for _, m := range messages {
+		if c.opts.MaxDeliveries > 0 && deliveries(m) > c.opts.MaxDeliveries {
+			c.deadLetter(ctx, m, fmt.Sprintf("max deliveries exceeded: %d", c.opts.MaxDeliveries))
+			continue
+		}
+
+		retries = append(retries, m)
+	}
+
+	c.execute(ctx, retries)
+}
+
+func (c *Consumer) deadLetter(ctx context.Context, m entity.Message, reason string) {
+	if m.ClaimCheck != "" && m.Payload == "" {
+		messages := []entity.Message{m}
+		if err := c.repo.LoadPayloads(ctx, messages); err != nil {
+			c.logger.Err(fmt.Sprintf("load claim-check payload of %s: %v\n", m.ID, err))
+			return
+		}
+
+		m = messages[0]
+	}
+
+	err := c.repo.DeadLetterMessage(ctx, entity.DeadLetterMessageDTO{
+		Queue:      c.opts.Queue,
+		Group:      c.opts.Group,
+		ConsumerID: c.opts.ID,
+		Message:    m,
+		Reason:     reason,
+	})
+	if err != nil {
+		c.logger.Err(fmt.Sprintf("dead letter message %s: %v\n", m.ID, err))
+		return
+	}
+
+	c.logger.Info(fmt.Sprintf("msg # %s moved to dead-letter queue: %s", m.ID, reason))
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
 }
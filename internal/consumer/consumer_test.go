@@ -0,0 +1,80 @@
+package consumer
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+// fakeRepo records the calls of the consumer, the methods a test does not expect panic on the nil repo.
+type fakeRepo struct {
+	repo
+
+	mu          sync.Mutex
+	acked       map[string][]string
+	claimChecks []entity.Message
+	deadLetters []entity.DeadLetterMessageDTO
+	retries     []entity.RetryMessageDTO
+}
+
+func (r *fakeRepo) AckMessages(_ context.Context, queue, _ string, ids []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.acked == nil {
+		r.acked = make(map[string][]string)
+	}
+
+	r.acked[queue] = append(r.acked[queue], ids...)
+
+	return nil
+}
+
+func (r *fakeRepo) AckClaimCheck(_ context.Context, _ string, m entity.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.claimChecks = append(r.claimChecks, m)
+
+	return nil
+}
+
+func (r *fakeRepo) DeadLetterMessage(_ context.Context, dto entity.DeadLetterMessageDTO) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.deadLetters = append(r.deadLetters, dto)
+
+	return nil
+}
+
+func (r *fakeRepo) RetryMessage(_ context.Context, dto entity.RetryMessageDTO) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.retries = append(r.retries, dto)
+
+	return true, nil
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Err(string)     {}
+func (nopLogger) Info(string)    {}
+func (nopLogger) Success(string) {}
+
+func newTestConsumer(t *testing.T, r *fakeRepo, opts Opts) *Consumer {
+	t.Helper()
+
+	if opts.Queue == "" {
+		opts.Queue = "q"
+	}
+
+	if opts.Group == "" {
+		opts.Group = "g"
+	}
+
+	return New(Params{Logger: nopLogger{}, Repo: r, Opts: opts})
+}
@@ -0,0 +1,76 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+// ExpiredAction is what the consumer does with messages that expired before they were handled.
+type ExpiredAction string
+
+const (
+	// ExpiredDiscard acks expired messages without handling them.
+	ExpiredDiscard ExpiredAction = "discard"
+	// ExpiredDeadLetter moves expired messages to the dead-letter queue of the group.
+	ExpiredDeadLetter ExpiredAction = "deadletter"
+)
+
+// dropExpired removes the expired messages by the expired action and returns the rest of them.
+// Expired retries of other groups are only acked, the action is applied by the group of the retry.
+func (c *Consumer) dropExpired(ctx context.Context, messages []entity.Message) []entity.Message {
+	var (
+		now     = time.Now()
+		live    = messages[:0:0]
+		expired = make(map[string][]entity.Message)
+		count   int
+	)
+
+	for _, m := range messages {
+		if !m.Expired(now) {
+			live = append(live, m)
+			continue
+		}
+
+		if !c.owns(m) {
+			expired[m.Queue] = append(expired[m.Queue], m)
+			continue
+		}
+
+		count++
+
+		if c.opts.Expired == ExpiredDeadLetter {
+			c.deadLetter(ctx, m, fmt.Sprintf("expired at %s", m.ExpiresAt.Format(time.RFC3339)))
+			continue
+		}
+
+		if m.ClaimCheck != "" {
+			if err := c.ack(ctx, m); err != nil {
+				c.logger.Err(fmt.Sprintf("ack expired message %s: %v\n", m.ID, err))
+			}
+
+			continue
+		}
+
+		expired[m.Queue] = append(expired[m.Queue], m)
+	}
+
+	for queue, ms := range expired {
+		ids := make([]string, 0, len(ms))
+		for _, m := range ms {
+			ids = append(ids, m.ID)
+		}
+
+		if err := c.repo.AckMessages(ctx, queue, c.opts.Group, ids); err != nil {
+			c.logger.Err(fmt.Sprintf("ack expired messages of %s: %v\n", queue, err))
+		}
+	}
+
+	if count > 0 {
+		c.logger.Info(fmt.Sprintf("%d expired messages dropped in group %s: %s", count, c.opts.Group, c.opts.Expired))
+	}
+
+	return live
+}
@@ -0,0 +1,58 @@
+package consumer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+func TestDropExpired(t *testing.T) {
+	r := &fakeRepo{}
+	c := newTestConsumer(t, r, Opts{Expired: ExpiredDeadLetter})
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Minute)
+
+	live := c.dropExpired(context.Background(), []entity.Message{
+		{ID: "1", Queue: "q", ExpiresAt: &past},
+		{ID: "2", Queue: "q", ExpiresAt: &past, RetryGroup: "other"},
+		{ID: "3", Queue: "q", ExpiresAt: &past, RetryGroup: "g"},
+		{ID: "4", Queue: "q", ExpiresAt: &future},
+		{ID: "5", Queue: "q"},
+	})
+
+	if len(live) != 2 || live[0].ID != "4" || live[1].ID != "5" {
+		t.Fatalf("live messages: %+v", live)
+	}
+
+	if len(r.deadLetters) != 2 || r.deadLetters[0].Message.ID != "1" || r.deadLetters[1].Message.ID != "3" {
+		t.Fatalf("dead letters: %+v", r.deadLetters)
+	}
+
+	if acked := r.acked["q"]; len(acked) != 1 || acked[0] != "2" {
+		t.Fatalf("acked: %v, want the expired retry of the other group", acked)
+	}
+}
+
+func TestDropExpiredReleasesClaimCheck(t *testing.T) {
+	r := &fakeRepo{}
+	c := newTestConsumer(t, r, Opts{Expired: ExpiredDiscard})
+
+	past := time.Now().Add(-time.Minute)
+
+	c.dropExpired(context.Background(), []entity.Message{
+		{ID: "1", Queue: "q", ExpiresAt: &past, ClaimCheck: "blob"},
+		{ID: "2", Queue: "q", ExpiresAt: &past, ClaimCheck: "blob", RetryGroup: "other"},
+		{ID: "3", Queue: "q", ExpiresAt: &past},
+	})
+
+	if len(r.claimChecks) != 1 || r.claimChecks[0].ID != "1" {
+		t.Fatalf("claim-check acks: %+v, want only the message of the group", r.claimChecks)
+	}
+
+	if acked := r.acked["q"]; len(acked) != 2 || acked[0] != "2" || acked[1] != "3" {
+		t.Fatalf("acked: %v", acked)
+	}
+}
@@ -2,35 +2,90 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
 
 	"github.com/pkg/errors"
 	"github.com/veleton777/redis_queue/internal/entity"
 )
 
+// ErrUnknownEventType is returned for messages with an event type that has no registered handler,
+// retrying such messages does not help, so they are moved to the dead-letter queue right away.
+var ErrUnknownEventType = errors.New("unknown event type")
+
+// ErrDecodePayload is returned when the payload can't be decoded into the type of the handler,
+// like ErrUnknownEventType it is not retried.
+var ErrDecodePayload = errors.New("decode payload")
+
+type Func func(ctx context.Context, m entity.Message) error
+
+// TypedFunc gets the payload of the message already decoded.
+type TypedFunc[T any] func(ctx context.Context, payload T, m entity.Message) error
+
 type Handler struct {
+	mu       sync.RWMutex
+	handlers map[entity.EventType]Func
+	// legacyType is the type of messages produced before the type was added to them, zero disables it.
+	legacyType entity.EventType
 }
 
-type EventType int
+func NewHandler() *Handler {
+	return &Handler{
+		handlers: make(map[entity.EventType]Func),
+	}
+}
 
-const (
-	EventTypeUser EventType = 1
-)
+// SetLegacyType sets the event type of messages without a type, e.g. produced by the old producer.
+func (h *Handler) SetLegacyType(evt entity.EventType) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-func NewHandler() *Handler {
-	return &Handler{}
+	h.legacyType = evt
 }
 
-func (h *Handler) Handle(ctx context.Context, evt EventType, m entity.Message) error {
-	var err error
+// Register sets the handler for the event type, it replaces the previously registered one.
+func (h *Handler) Register(evt entity.EventType, f Func) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-	switch evt {
-	case EventTypeUser:
-		if err = h.User(ctx, m); err != nil {
-			return errors.Wrap(err, "handle user")
-		}
-	default:
-		return errors.Errorf("unknown event type: %d", evt)
+	h.handlers[evt] = f
+}
+
+func (h *Handler) Handle(ctx context.Context, m entity.Message) error {
+	h.mu.RLock()
+	if m.Type == 0 {
+		m.Type = h.legacyType
+	}
+
+	f, ok := h.handlers[m.Type]
+	h.mu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownEventType, m.Type)
+	}
+
+	if err := f(ctx, m); err != nil {
+		return errors.Wrapf(err, "handle event type %d", m.Type)
 	}
 
 	return nil
 }
+
+// RegisterHandler sets the handler for the event type which decodes the json payload into T.
+// The payload is json whatever the codec of the queue is, the codec encodes only the message around it.
+func RegisterHandler[T any](h *Handler, evt entity.EventType, f TypedFunc[T]) {
+	h.Register(evt, func(ctx context.Context, m entity.Message) error {
+		var payload T
+		if err := json.Unmarshal([]byte(m.Payload), &payload); err != nil {
+			return fmt.Errorf("%w: %w", ErrDecodePayload, err)
+		}
+
+		return f(ctx, payload, m)
+	})
+}
+
+// IsNonRetryable reports whether the message failed with an error that redelivery can't fix.
+func IsNonRetryable(err error) bool {
+	return errors.Is(err, ErrUnknownEventType) || errors.Is(err, ErrDecodePayload)
+}
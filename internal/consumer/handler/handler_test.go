@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/veleton777/redis_queue/internal/codec"
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+func TestHandleLegacyType(t *testing.T) {
+	h := NewHandler()
+
+	var got entity.EventType
+	h.Register(entity.EventTypeUser, func(_ context.Context, m entity.Message) error {
+		got = m.Type
+		return nil
+	})
+
+	err := h.Handle(context.Background(), entity.Message{ID: "1"})
+	if !errors.Is(err, ErrUnknownEventType) {
+		t.Fatalf("message without type and legacy type: got %v, want ErrUnknownEventType", err)
+	}
+
+	h.SetLegacyType(entity.EventTypeUser)
+
+	if err := h.Handle(context.Background(), entity.Message{ID: "1"}); err != nil {
+		t.Fatalf("message without type: %v", err)
+	}
+
+	if got != entity.EventTypeUser {
+		t.Fatalf("handler got type %d, want %d", got, entity.EventTypeUser)
+	}
+}
+
+func TestRegisterHandlerDecodeError(t *testing.T) {
+	h := NewHandler()
+
+	RegisterHandler(h, entity.EventTypeUser, func(context.Context, entity.User, entity.Message) error {
+		t.Fatal("handler is called with a payload that can't be decoded")
+		return nil
+	})
+
+	err := h.Handle(context.Background(), entity.Message{ID: "1", Type: entity.EventTypeUser, Payload: "{"})
+	if !errors.Is(err, ErrDecodePayload) || !IsNonRetryable(err) {
+		t.Fatalf("got %v, want non-retryable ErrDecodePayload", err)
+	}
+
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Fatalf("decode error %v does not keep the json error", err)
+	}
+}
+
+func TestRegisterHandlerAnyCodec(t *testing.T) {
+	want := entity.User{ID: "1", Name: "name", Age: 30}
+
+	payload, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("json marshal payload: %v", err)
+	}
+
+	for _, name := range []string{"json", "msgpack", "protobuf"} {
+		enc, err := codec.NewEncoder(name, "", 0)
+		if err != nil {
+			t.Fatalf("new encoder %s: %v", name, err)
+		}
+
+		data, headers, err := enc.Encode(entity.Message{ID: "1", Type: entity.EventTypeUser, Payload: string(payload)})
+		if err != nil {
+			t.Fatalf("encode %s: %v", name, err)
+		}
+
+		m, err := codec.Decode(data, headers)
+		if err != nil {
+			t.Fatalf("decode %s: %v", name, err)
+		}
+
+		var got entity.User
+
+		h := NewHandler()
+		RegisterHandler(h, entity.EventTypeUser, func(_ context.Context, u entity.User, _ entity.Message) error {
+			got = u
+			return nil
+		})
+
+		if err := h.Handle(context.Background(), m); err != nil {
+			t.Fatalf("handle %s message: %v", name, err)
+		}
+
+		if got != want {
+			t.Fatalf("%s message: got payload %+v, want %+v", name, got, want)
+		}
+	}
+}
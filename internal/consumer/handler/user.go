@@ -6,7 +6,7 @@ import (
 	"github.com/veleton777/redis_queue/internal/entity"
 )
 
-func (h *Handler) User(ctx context.Context, m entity.Message) error {
+func User(ctx context.Context, u entity.User, m entity.Message) error {
 
 	return nil
 }
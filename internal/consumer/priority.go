@@ -0,0 +1,70 @@
+package consumer
+
+import (
+	"math/rand"
+)
+
+// Order is how the consumer chooses between the priority streams of the queue.
+type Order string
+
+const (
+	// OrderStrict reads a stream only when all streams before it are empty.
+	OrderStrict Order = "strict"
+	// OrderWeighted reads a stream chosen at random in proportion to its weight first,
+	// so streams of low priorities are not starved while the high ones are busy.
+	OrderWeighted Order = "weighted"
+)
+
+// Stream is one priority stream of the queue, every group has its own consumer group in it.
+type Stream struct {
+	Queue string
+	// Weight is the share of reads of the stream in the weighted order.
+	Weight int
+}
+
+// readOrder returns the streams in the order they are read in this iteration.
+func (c *Consumer) readOrder() []string {
+	queues := make([]string, 0, len(c.opts.Streams))
+
+	first := -1
+	if c.opts.Order == OrderWeighted {
+		first = c.weightedStream()
+		queues = append(queues, c.opts.Streams[first].Queue)
+	}
+
+	for i, s := range c.opts.Streams {
+		if i != first {
+			queues = append(queues, s.Queue)
+		}
+	}
+
+	return queues
+}
+
+func (c *Consumer) weightedStream() int {
+	var total int
+	for _, s := range c.opts.Streams {
+		total += s.Weight
+	}
+
+	n := rand.Intn(total)
+
+	for i, s := range c.opts.Streams {
+		if n < s.Weight {
+			return i
+		}
+
+		n -= s.Weight
+	}
+
+	return 0
+}
+
+func (c *Consumer) queues() []string {
+	queues := make([]string, 0, len(c.opts.Streams))
+	for _, s := range c.opts.Streams {
+		queues = append(queues, s.Queue)
+	}
+
+	return queues
+}
@@ -0,0 +1,105 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+// Backoff is the policy of delays between attempts of a failed message.
+// The delay of attempt n is Base * Factor^(n-1) limited by Max and shifted by up to Jitter of itself.
+type Backoff struct {
+	// Base is the delay before the first retry, zero disables retries through the delayed queue
+	// and failed messages are reclaimed from the pending entries list instead.
+	Base   time.Duration
+	Factor float64
+	Max    time.Duration
+	// Jitter is the fraction of the delay in [0, 1] it is randomly changed by, bigger values are taken as 1.
+	Jitter float64
+}
+
+func (b Backoff) enabled() bool {
+	return b.Base > 0
+}
+
+// Delay returns the delay before the given attempt, attempts start with 1.
+func (b Backoff) Delay(attempt int64) time.Duration {
+	factor := b.Factor
+	if factor < 1 {
+		factor = 1
+	}
+
+	// without Max the delay grows past the longest duration, a bigger float has no valid conversion
+	maxDelay := float64(math.MaxInt64)
+	if b.Max > 0 {
+		maxDelay = float64(b.Max)
+	}
+
+	delay := min(float64(b.Base)*math.Pow(factor, float64(attempt-1)), maxDelay)
+
+	if jitter := min(b.Jitter, 1); jitter > 0 {
+		delay += delay * jitter * (2*rand.Float64() - 1)
+	}
+
+	if delay >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+
+	return time.Duration(delay)
+}
+
+// retry acks the failed message and schedules its copy with the next attempt number in the delayed queue.
+// The copy is received by every group of the queue, so it is marked with the group that has to handle it.
+func (c *Consumer) retry(ctx context.Context, m entity.Message, handleErr error) {
+	attempt := m.Attempt + 1
+
+	if c.opts.MaxDeliveries > 0 && deliveries(m) >= c.opts.MaxDeliveries {
+		c.deadLetter(ctx, m, handleErr.Error())
+		return
+	}
+
+	delay := c.opts.Backoff.Delay(attempt)
+
+	retry := m
+	retry.ID = uuid.New().String()
+	retry.Attempt = attempt
+	retry.RetryGroup = c.opts.Group
+	retry.OriginID = m.SourceID()
+
+	// the offloaded payload is kept until the retry is done, the copy only refers to it
+	if retry.ClaimCheck != "" {
+		retry.Payload = ""
+	}
+
+	scheduled, err := c.repo.RetryMessage(ctx, entity.RetryMessageDTO{
+		Queue:       c.opts.Queue,
+		Group:       c.opts.Group,
+		SourceQueue: m.Queue,
+		SourceID:    m.ID,
+		SourceRetry: m.RetryGroup != "",
+		Message:     retry,
+		At:          time.Now().Add(delay),
+	})
+	if err != nil {
+		c.logger.Err(fmt.Sprintf("retry message %s: %v\n", m.ID, err))
+		return
+	}
+
+	if !scheduled {
+		c.logger.Info(fmt.Sprintf("msg # %s is already acked by another consumer, retry skipped", m.ID))
+		return
+	}
+
+	c.logger.Info(fmt.Sprintf("msg # %s scheduled for retry %d in %s", m.ID, attempt, delay))
+}
+
+// deliveries returns how many times the message was delivered including the previous attempts
+// which were retried through the delayed queue.
+func deliveries(m entity.Message) int64 {
+	return m.Attempt + m.Deliveries
+}
@@ -0,0 +1,79 @@
+package consumer
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Base: time.Second, Factor: 2, Max: 5 * time.Second}
+
+	for attempt, want := range map[int64]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second} {
+		if got := b.Delay(attempt); got != want {
+			t.Fatalf("attempt %d: got %s, want %s", attempt, got, want)
+		}
+	}
+
+	b.Jitter = 5
+
+	for i := 0; i < 1000; i++ {
+		if got := b.Delay(1); got < 0 || got > 2*time.Second {
+			t.Fatalf("delay with jitter out of [0, 1]: got %s, want within [0s, 2s]", got)
+		}
+	}
+}
+
+func TestBackoffDelayWithoutMax(t *testing.T) {
+	b := Backoff{Base: time.Second, Factor: 2}
+
+	for _, attempt := range []int64{62, 100, 10000} {
+		if got := b.Delay(attempt); got != math.MaxInt64 {
+			t.Fatalf("attempt %d: got %s, want the longest duration", attempt, got)
+		}
+	}
+
+	b.Jitter = 1
+
+	for i := 0; i < 1000; i++ {
+		if got := b.Delay(10000); got <= 0 {
+			t.Fatalf("delay with jitter: got %s, want a positive one", got)
+		}
+	}
+}
+
+func TestRetryKeepsOriginID(t *testing.T) {
+	r := &fakeRepo{}
+	c := newTestConsumer(t, r, Opts{Backoff: Backoff{Base: time.Second}})
+
+	m := entity.Message{ID: "1-0", Queue: "q", Deliveries: 1}
+
+	c.retry(context.Background(), m, errors.New("failed"))
+
+	if len(r.retries) != 1 {
+		t.Fatalf("got %d retries, want 1", len(r.retries))
+	}
+
+	first := r.retries[0].Message
+	if first.OriginID != "1-0" || first.Attempt != 1 {
+		t.Fatalf("first retry: origin id %q, attempt %d", first.OriginID, first.Attempt)
+	}
+
+	// the retry is read from the stream with a new id
+	first.ID = "2-0"
+
+	c.retry(context.Background(), first, errors.New("failed"))
+
+	second := r.retries[1].Message
+	if second.OriginID != "1-0" || second.Attempt != 2 {
+		t.Fatalf("second retry: origin id %q, attempt %d", second.OriginID, second.Attempt)
+	}
+
+	if r.retries[1].SourceID != "2-0" {
+		t.Fatalf("second retry acks %q, want the retry read from the stream", r.retries[1].SourceID)
+	}
+}
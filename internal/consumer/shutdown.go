@@ -0,0 +1,154 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+// cleanupTimeout bounds handing over pending messages and leaving the group,
+// it is applied even if the shutdown deadline is already exceeded.
+const cleanupTimeout = 5 * time.Second
+
+// Shutdown is called after the ctx of Run is cancelled. It waits for the in-flight messages until ctx is done,
+// hands the messages left pending over to a live consumer of the group and removes the consumer from the group.
+// The consumer stays in the group of a stream if there is no live consumer to take its pending messages.
+func (c *Consumer) Shutdown(ctx context.Context) error {
+	if !c.registered.Load() {
+		return nil
+	}
+
+	if err := c.drain(ctx); err != nil {
+		c.logger.Err(fmt.Sprintf("drain consumer: %v\n", err))
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+
+	for _, s := range c.opts.Streams {
+		if err := c.leave(ctx, s.Queue); err != nil {
+			return errors.Wrapf(err, "leave %s", s.Queue)
+		}
+	}
+
+	return nil
+}
+
+// leave hands the pending messages of the stream over and removes the consumer from the group of the stream.
+func (c *Consumer) leave(ctx context.Context, queue string) error {
+	pending, err := c.handOverPending(ctx, queue)
+	if err != nil {
+		return errors.Wrap(err, "hand over pending messages")
+	}
+
+	if pending > 0 {
+		c.logger.Info(fmt.Sprintf("consumer %s is left in the group of %s with %d pending messages: no live consumers", c.opts.ID, queue, pending))
+		return nil
+	}
+
+	if err = c.repo.RemoveConsumer(ctx, queue, c.opts.Group, c.opts.ID); err != nil {
+		return errors.Wrap(err, "remove consumer")
+	}
+
+	return nil
+}
+
+// drain waits for the in-flight messages, on ctx done their handlers are cancelled
+// and the messages stay pending.
+func (c *Consumer) drain(ctx context.Context) error {
+	done := make(chan struct{})
+
+	go func() {
+		c.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		c.cancelWork()
+		return errors.Wrap(ctx.Err(), "wait in-flight messages")
+	}
+}
+
+// handOverPending claims the pending messages of the consumer for the most recently active live consumer
+// and returns how many messages are still pending on the consumer.
+func (c *Consumer) handOverPending(ctx context.Context, queue string) (int64, error) {
+	consumers, err := c.repo.Consumers(ctx, queue, c.opts.Group)
+	if err != nil {
+		return 0, errors.Wrap(err, "get consumers")
+	}
+
+	target, ok := liveConsumer(consumers, c.opts.ID, 2*c.opts.CheckFailedMessagesTime)
+	if !ok {
+		return pendingOf(consumers, c.opts.ID), nil
+	}
+
+	var after string
+
+	for {
+		res, err := c.repo.ClaimPending(ctx, entity.ClaimPendingDTO{
+			Queue: queue,
+			Group: c.opts.Group,
+			From:  c.opts.ID,
+			To:    target.Name,
+			Limit: c.opts.TasksForIteration,
+			After: after,
+		})
+		if err != nil {
+			return 0, errors.Wrap(err, "claim pending messages")
+		}
+
+		if res.Last == "" {
+			break
+		}
+
+		after = res.Last
+
+		if res.Claimed > 0 {
+			c.logger.Info(fmt.Sprintf("%d pending messages handed over to consumer %s", res.Claimed, target.Name))
+		}
+	}
+
+	consumers, err = c.repo.Consumers(ctx, queue, c.opts.Group)
+	if err != nil {
+		return 0, errors.Wrap(err, "get consumers")
+	}
+
+	return pendingOf(consumers, c.opts.ID), nil
+}
+
+// liveConsumer returns the consumer with the least idle time except the given one,
+// consumers idle for maxIdle or longer are considered dead.
+func liveConsumer(consumers []entity.ConsumerInfo, except string, maxIdle time.Duration) (entity.ConsumerInfo, bool) {
+	var (
+		live  entity.ConsumerInfo
+		found bool
+	)
+
+	for _, ci := range consumers {
+		if ci.Name == except || ci.Idle >= maxIdle {
+			continue
+		}
+
+		if !found || ci.Idle < live.Idle {
+			live, found = ci, true
+		}
+	}
+
+	return live, found
+}
+
+func pendingOf(consumers []entity.ConsumerInfo, name string) int64 {
+	for _, ci := range consumers {
+		if ci.Name == name {
+			return ci.Pending
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,181 @@
+package cron
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/veleton777/redis_queue/internal/entity"
+	"github.com/veleton777/redis_queue/internal/logger"
+)
+
+// MissedPolicy tells what to do with ticks missed while no instance was running.
+type MissedPolicy string
+
+const (
+	// MissedSkip fires only the current tick.
+	MissedSkip MissedPolicy = "skip"
+	// MissedCatchUp fires every missed tick, at most MaxCatchUp of them.
+	MissedCatchUp MissedPolicy = "catchup"
+)
+
+type repo interface {
+	FireCronJob(ctx context.Context, dto entity.FireCronJobDTO) (int64, error)
+}
+
+// Job adds a message to the queue every period. Ticks are aligned to the unix epoch,
+// so all instances agree on them, e.g. a job with Every of 5m fires at 10:00, 10:05 and so on.
+// The message is added by the cron script, not by the producer: stream caps, claim-check and the spool don't apply.
+type Job struct {
+	// Name identifies the job in the fleet, the time of its last tick is kept in redis by it.
+	Name  string
+	Every time.Duration
+	// Queue is the queue the message is added to, the queue of the app is used if empty.
+	Queue string
+	// Priority is the stream of the queue the message is added to, empty for the normal priority.
+	Priority entity.Priority
+	Type     entity.EventType
+	Payload  string
+	Missed   MissedPolicy
+}
+
+// Cron fires the jobs. Any number of instances may run it: a tick is fired by one redis script
+// that checks and saves the last fired tick of the job, so only one instance fires each tick.
+// A tick is not fired into a stream without consumer groups, it is retried on the next check.
+type Cron struct {
+	logger logger.Logger
+	repo   repo
+	opts   Opts
+
+	mu   sync.RWMutex
+	jobs []Job
+}
+
+type Params struct {
+	Logger logger.Logger
+	Repo   repo
+
+	Opts Opts
+}
+
+type Opts struct {
+	Queue string
+	// Priorities are read by consumers of Queue, jobs of Queue with another priority are rejected.
+	Priorities []entity.Priority
+	// Interval is the time between checks of the jobs, it should be less than the period of any job.
+	Interval time.Duration
+	// MaxCatchUp is the max number of missed ticks fired at once for jobs with MissedCatchUp.
+	MaxCatchUp int
+}
+
+func New(params Params) *Cron {
+	return &Cron{
+		logger: params.Logger,
+		repo:   params.Repo,
+		opts:   params.Opts,
+	}
+}
+
+func (c *Cron) AddJob(job Job) error {
+	if job.Name == "" {
+		return errors.New("empty job name")
+	}
+
+	if job.Every < time.Millisecond {
+		return errors.Errorf("job %s: period is less than 1ms", job.Name)
+	}
+
+	switch job.Missed {
+	case "":
+		job.Missed = MissedSkip
+	case MissedSkip, MissedCatchUp:
+	default:
+		return errors.Errorf("job %s: unknown missed ticks policy: %s", job.Name, job.Missed)
+	}
+
+	if job.Queue == "" {
+		job.Queue = c.opts.Queue
+	}
+
+	priority, err := entity.ParsePriority(string(job.Priority))
+	if err != nil {
+		return errors.Wrapf(err, "job %s", job.Name)
+	}
+
+	if job.Queue == c.opts.Queue && !slices.Contains(c.opts.Priorities, priority) {
+		return errors.Wrapf(entity.ErrUnknownPriority, "job %s: %s is not read by consumers of %s", job.Name, priority, job.Queue)
+	}
+
+	job.Priority = priority
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, j := range c.jobs {
+		if j.Name == job.Name {
+			return errors.Errorf("job %s already exists", job.Name)
+		}
+	}
+
+	c.jobs = append(c.jobs, job)
+
+	return nil
+}
+
+func (c *Cron) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			c.fire(ctx, now)
+		}
+	}
+}
+
+func (c *Cron) fire(ctx context.Context, now time.Time) {
+	c.mu.RLock()
+	jobs := c.jobs
+	c.mu.RUnlock()
+
+	for _, job := range jobs {
+		fired, err := c.repo.FireCronJob(ctx, entity.FireCronJobDTO{
+			Name:       job.Name,
+			Queue:      job.Queue,
+			Tick:       lastTick(now, job.Every),
+			Every:      job.Every,
+			CatchUp:    job.Missed == MissedCatchUp,
+			MaxCatchUp: c.opts.MaxCatchUp,
+			Message: entity.Message{
+				ID:       uuid.New().String(),
+				Type:     job.Type,
+				Payload:  job.Payload,
+				Priority: job.Priority,
+			},
+		})
+		if err != nil {
+			if ctx.Err() == nil {
+				c.logger.Err(fmt.Sprintf("fire cron job %s: %v\n", job.Name, err))
+			}
+			continue
+		}
+
+		if fired > 0 {
+			c.logger.Info(fmt.Sprintf("cron job %s fired %d times", job.Name, fired))
+		}
+	}
+}
+
+// lastTick returns the latest tick of the period which is not after now.
+func lastTick(now time.Time, every time.Duration) time.Time {
+	ms := now.UnixMilli()
+
+	return time.UnixMilli(ms - ms%every.Milliseconds())
+}
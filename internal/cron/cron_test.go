@@ -0,0 +1,129 @@
+package cron
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+type fakeRepo struct {
+	mu    sync.Mutex
+	fired []entity.FireCronJobDTO
+}
+
+func (r *fakeRepo) FireCronJob(_ context.Context, dto entity.FireCronJobDTO) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.fired = append(r.fired, dto)
+
+	return 1, nil
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Err(string)     {}
+func (nopLogger) Info(string)    {}
+func (nopLogger) Success(string) {}
+
+func TestLastTick(t *testing.T) {
+	now := time.UnixMilli(1_700_000_123_456)
+
+	for every, want := range map[time.Duration]int64{
+		time.Millisecond: 1_700_000_123_456,
+		time.Second:      1_700_000_123_000,
+		time.Minute:      1_700_000_100_000,
+		time.Hour:        1_699_999_200_000,
+	} {
+		if got := lastTick(now, every).UnixMilli(); got != want {
+			t.Fatalf("last tick of %s: got %d, want %d", every, got, want)
+		}
+	}
+}
+
+func TestAddJob(t *testing.T) {
+	c := New(Params{Logger: nopLogger{}, Repo: &fakeRepo{}, Opts: Opts{
+		Queue:      "q",
+		Priorities: []entity.Priority{entity.PriorityNormal, entity.PriorityLow},
+	}})
+
+	for _, job := range []Job{
+		{Every: time.Minute},
+		{Name: "sub-ms", Every: time.Microsecond},
+		{Name: "policy", Every: time.Minute, Missed: "later"},
+		{Name: "priority", Every: time.Minute, Priority: "urgent"},
+		{Name: "unread", Every: time.Minute, Priority: entity.PriorityHigh},
+	} {
+		if err := c.AddJob(job); err == nil {
+			t.Fatalf("add job %+v: expected error", job)
+		}
+	}
+
+	if err := c.AddJob(Job{Name: "job", Every: time.Minute}); err != nil {
+		t.Fatalf("add job: %v", err)
+	}
+
+	if err := c.AddJob(Job{Name: "job", Every: time.Hour}); err == nil {
+		t.Fatal("add job with the same name: expected error")
+	}
+
+	if err := c.AddJob(Job{Name: "low", Every: time.Minute, Priority: entity.PriorityLow}); err != nil {
+		t.Fatalf("add job with a read priority: %v", err)
+	}
+
+	if err := c.AddJob(Job{Name: "other", Every: time.Minute, Queue: "other", Priority: entity.PriorityHigh}); err != nil {
+		t.Fatalf("add job of another queue: %v", err)
+	}
+}
+
+func TestAddJobWithoutNormalPriority(t *testing.T) {
+	c := New(Params{Logger: nopLogger{}, Repo: &fakeRepo{}, Opts: Opts{
+		Queue:      "q",
+		Priorities: []entity.Priority{entity.PriorityHigh},
+	}})
+
+	err := c.AddJob(Job{Name: "job", Every: time.Minute})
+	if !errors.Is(err, entity.ErrUnknownPriority) {
+		t.Fatalf("add job of the unread normal priority: got %v, want ErrUnknownPriority", err)
+	}
+}
+
+func TestFire(t *testing.T) {
+	r := &fakeRepo{}
+	c := New(Params{Logger: nopLogger{}, Repo: r, Opts: Opts{
+		Queue:      "q",
+		Priorities: entity.Priorities,
+		MaxCatchUp: 5,
+	}})
+
+	if err := c.AddJob(Job{Name: "skip", Every: time.Minute, Type: 1, Payload: "p", Priority: entity.PriorityHigh}); err != nil {
+		t.Fatalf("add job: %v", err)
+	}
+
+	if err := c.AddJob(Job{Name: "catchup", Every: time.Hour, Queue: "other", Missed: MissedCatchUp}); err != nil {
+		t.Fatalf("add job: %v", err)
+	}
+
+	now := time.UnixMilli(1_700_000_123_456)
+	c.fire(context.Background(), now)
+
+	if len(r.fired) != 2 {
+		t.Fatalf("fired %d jobs, want 2", len(r.fired))
+	}
+
+	skip, catchUp := r.fired[0], r.fired[1]
+
+	if skip.Queue != "q" || skip.CatchUp || !skip.Tick.Equal(lastTick(now, time.Minute)) || skip.Message.Payload != "p" ||
+		skip.Message.Priority != entity.PriorityHigh {
+		t.Fatalf("skip job: %+v", skip)
+	}
+
+	if catchUp.Queue != "other" || !catchUp.CatchUp || catchUp.MaxCatchUp != 5 || !catchUp.Tick.Equal(lastTick(now, time.Hour)) ||
+		catchUp.Message.Priority != entity.PriorityNormal {
+		t.Fatalf("catch-up job: %+v", catchUp)
+	}
+}
@@ -1,6 +1,11 @@
 package entity
 
-import "time"
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
 
 type User struct {
 	ID   string `json:"id"`
@@ -8,17 +13,111 @@ type User struct {
 	Age  int    `json:"age"`
 }
 
+type EventType int
+
+const (
+	EventTypeUser EventType = 1
+)
+
+// Priority selects the stream of the queue the message is added to, consumers read streams
+// of higher priorities first. The normal priority is the queue stream itself.
+type Priority string
+
+const (
+	PriorityHigh   Priority = "high"
+	PriorityNormal Priority = "normal"
+	PriorityLow    Priority = "low"
+)
+
+// Priorities are all priorities from the highest one.
+var Priorities = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// ErrUnknownPriority is returned for a priority other than high, normal and low
+// or for a priority which is not read by consumers of the queue.
+var ErrUnknownPriority = errors.New("unknown priority")
+
+// ParsePriority returns the priority by its name, an empty name is the normal priority.
+func ParsePriority(s string) (Priority, error) {
+	switch p := Priority(s); p {
+	case "":
+		return PriorityNormal, nil
+	case PriorityHigh, PriorityNormal, PriorityLow:
+		return p, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownPriority, s)
+	}
+}
+
 type Message struct {
-	ID      string `json:"id"`
-	Payload string `json:"payload"`
+	ID      string    `json:"id"`
+	Type    EventType `json:"type"`
+	Payload string    `json:"payload"`
+	// Attempt is the number of failed attempts of the message retried through the delayed queue.
+	Attempt int64 `json:"attempt,omitempty"`
+	// RetryGroup is the only consumer group that handles the retried message, other groups skip it.
+	RetryGroup string `json:"retry_group,omitempty"`
+	// Priority is empty for the normal priority.
+	Priority Priority `json:"priority,omitempty"`
+	// IdempotencyKey identifies the message for the producer, the message is added to the queue
+	// once within the dedup window however many times it is produced.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// ExpiresAt is the time after which the message is not handled, nil means it never expires.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Headers are the metadata of the message, e.g. trace id or content type. They are kept
+	// in separate fields of the stream entry, not in the json of the message.
+	Headers map[string]string `json:"-"`
+	// OriginID is the stream id of the message a retry was made from, it is empty for the original message.
+	OriginID string `json:"origin_id,omitempty"`
+	// ClaimCheck is the key of the payload offloaded from the stream, the payload is empty until it is loaded.
+	ClaimCheck string `json:"claim_check,omitempty"`
+
+	// Deliveries is how many times the message was delivered to the group, it is filled on read.
+	Deliveries int64 `json:"-"`
+	// Queue is the stream the message is read from, it is filled on read.
+	Queue string `json:"-"`
+	// DeadLetter is filled only for messages read from a dead-letter queue.
+	DeadLetter *DeadLetter `json:"-"`
+}
+
+// Header returns the header by its name, it is empty if the message has no such header.
+func (m Message) Header(name string) string {
+	return m.Headers[name]
+}
+
+// SourceID returns the stream id the message was produced with, it is the same for all retries of the message.
+func (m Message) SourceID() string {
+	if m.OriginID != "" {
+		return m.OriginID
+	}
+
+	return m.ID
+}
+
+// Expired reports whether the message expired by the given time.
+func (m Message) Expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !now.Before(*m.ExpiresAt)
+}
+
+type DeadLetter struct {
+	SourceID   string
+	Error      string
+	ConsumerID string
+	Deliveries int64
+	ProducedAt time.Time
+	FailedAt   time.Time
 }
 
 type GetMessagesDTO struct {
 	ConsumerID string
-	BlockTime  time.Duration
-	Queue      string
-	Group      string
-	Limit      int
+	// BlockTime of zero returns at once if there are no messages.
+	BlockTime time.Duration
+	// Queues are the streams read at once, messages are returned in the order of the streams.
+	Queues []string
+	Group  string
+	Limit  int
+	// DeadLetterQueue is the queue whose dead-letter stream of the group takes the entries
+	// which can't be decoded, the stream of the entry is used if empty.
+	DeadLetterQueue string
 }
 
 type GetFailedMessagesDTO struct {
@@ -27,4 +126,172 @@ type GetFailedMessagesDTO struct {
 	Group              string
 	IdleTimeForMessage time.Duration
 	Limit              int
+	// DeadLetterQueue is like GetMessagesDTO.DeadLetterQueue, Queue is used if empty.
+	DeadLetterQueue string
+}
+
+type DeadLetterMessageDTO struct {
+	Queue      string
+	Group      string
+	ConsumerID string
+	Message    Message
+	// Reason is saved as the error of the message if the handler has not saved one.
+	Reason string
+}
+
+// ErrQueueFull is returned on produce to a stream which reached its max length in the reject mode.
+var ErrQueueFull = errors.New("queue is full")
+
+// ErrNoReader is returned when a cron job fires into a stream without consumer groups,
+// no consumer would read the message.
+var ErrNoReader = errors.New("stream has no consumer groups")
+
+// ErrUnavailable is returned on produce when redis can't be reached.
+var ErrUnavailable = errors.New("redis is unavailable")
+
+// ErrSpooled is returned on produce when redis can't be reached and the message is kept in the spool,
+// it is produced once redis is back. The message has no stream id yet.
+var ErrSpooled = errors.New("message is spooled")
+
+// CapMode is how the length of the stream is limited on produce.
+type CapMode string
+
+const (
+	CapNone CapMode = ""
+	// CapMaxLen trims the stream to about MaxLen entries.
+	CapMaxLen CapMode = "maxlen"
+	// CapMinID trims the entries older than MaxAge.
+	CapMinID CapMode = "minid"
+	// CapReject refuses the message with ErrQueueFull if the stream has MaxLen entries.
+	CapReject CapMode = "reject"
+)
+
+// StreamCap limits the length of the stream in the same step the message is added,
+// trimming is approximate and removes whole macro nodes of the stream.
+type StreamCap struct {
+	Mode   CapMode
+	MaxLen int64
+	MaxAge time.Duration
+}
+
+// ClaimCheckPolicy offloads payloads longer than Threshold bytes to a separate key kept for TTL,
+// zero threshold disables offloading.
+type ClaimCheckPolicy struct {
+	Threshold int
+	TTL       time.Duration
+}
+
+type ProduceMessageDTO struct {
+	Queue   string
+	Message Message
+	// DedupWindow is how long the idempotency key of the message is kept, zero disables deduplication.
+	DedupWindow time.Duration
+	Cap         StreamCap
+	ClaimCheck  ClaimCheckPolicy
+}
+
+type ProduceBatchDTO struct {
+	Queue       string
+	Messages    []Message
+	DedupWindow time.Duration
+	Cap         StreamCap
+	ClaimCheck  ClaimCheckPolicy
+}
+
+// ProduceResult is the outcome of producing one message of a batch.
+type ProduceResult struct {
+	ID  string
+	Err error
+}
+
+type RetryMessageDTO struct {
+	Queue string
+	Group string
+	// SourceQueue and SourceID are the stream and the id of the failed message which is acked.
+	SourceQueue string
+	SourceID    string
+	// SourceRetry is set if the failed message is a retry copy itself.
+	SourceRetry bool
+	// Message is the copy of the failed message scheduled by its id.
+	Message Message
+	At      time.Time
+}
+
+type GetDeadLetterMessagesDTO struct {
+	Queue string
+	Group string
+	// Start is the first dead-letter entry id to read, empty means from the beginning.
+	Start string
+	Limit int
+}
+
+type ScheduledMessage struct {
+	Message Message
+	At      time.Time
+}
+
+type SaveMessageErrorDTO struct {
+	Queue string
+	Group string
+	ID    string
+	Err   string
+}
+
+type ConsumerInfo struct {
+	Name    string
+	Pending int64
+	Idle    time.Duration
+}
+
+type ClaimPendingDTO struct {
+	Queue string
+	Group string
+	// From is the consumer whose pending messages are claimed.
+	From string
+	// To is the consumer which becomes the owner of the messages.
+	To    string
+	Limit int
+	// After is the id the pending messages are listed after, empty means from the first one.
+	After string
+}
+
+// ClaimPendingResult is the outcome of one ClaimPending call, a caller continues after Last
+// until there are no pending messages left.
+type ClaimPendingResult struct {
+	// Claimed is how many messages were moved, messages deleted from the stream are not counted.
+	Claimed int
+	// Last is the id of the last pending message looked at, it is empty if there were none.
+	Last string
+}
+
+type RemoveIdleConsumerDTO struct {
+	Queue      string
+	Group      string
+	ConsumerID string
+	// MinIdle is the idle time the consumer must have to be removed.
+	MinIdle time.Duration
+}
+
+type GroupInfo struct {
+	Name            string
+	Pending         int64
+	LastDeliveredID string
+}
+
+type PromoteDelayedDTO struct {
+	Queue string
+	// Until is the time up to which delayed messages are due.
+	Until time.Time
+	Limit int
+}
+
+type FireCronJobDTO struct {
+	Name  string
+	Queue string
+	Tick  time.Time
+	Every time.Duration
+	// CatchUp fires the ticks missed since the last fired one, at most MaxCatchUp of them.
+	CatchUp    bool
+	MaxCatchUp int
+	Message    Message
 }
@@ -0,0 +1,163 @@
+package janitor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veleton777/redis_queue/internal/entity"
+	"github.com/veleton777/redis_queue/internal/lock"
+	"github.com/veleton777/redis_queue/internal/logger"
+)
+
+type repo interface {
+	Consumers(ctx context.Context, queue, group string) ([]entity.ConsumerInfo, error)
+	ClaimPending(ctx context.Context, dto entity.ClaimPendingDTO) (entity.ClaimPendingResult, error)
+	RemoveIdleConsumer(ctx context.Context, dto entity.RemoveIdleConsumerDTO) (bool, error)
+}
+
+type locker interface {
+	Do(ctx context.Context, key string, f func(ctx context.Context) error) error
+}
+
+// Janitor removes consumers that stopped without leaving the group, e.g. after a crash or a restart
+// with a new consumer id. Their pending messages are claimed for a live consumer first.
+// Several janitors may run for the same group: a consumer is removed only if it is still idle
+// and has no pending messages at the moment of removal, and only one of them reaps the group at a time.
+type Janitor struct {
+	logger logger.Logger
+	repo   repo
+	locker locker
+	opts   Opts
+}
+
+type Params struct {
+	Logger logger.Logger
+	Repo   repo
+	Locker locker
+
+	Opts Opts
+}
+
+type Opts struct {
+	Queue string
+	Group string
+	// Interval is the time between checks of the group.
+	Interval time.Duration
+	// MaxIdle is the idle time after which a consumer is considered dead.
+	MaxIdle time.Duration
+	// ClaimLimit is the max number of pending messages claimed by one call.
+	ClaimLimit int
+}
+
+func New(params Params) *Janitor {
+	return &Janitor{
+		logger: params.Logger,
+		repo:   params.Repo,
+		locker: params.Locker,
+		opts:   params.Opts,
+	}
+}
+
+func (j *Janitor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(j.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			err := j.locker.Do(ctx, j.lockKey(), j.reap)
+			if err != nil && !errors.Is(err, lock.ErrNotAcquired) && ctx.Err() == nil {
+				j.logger.Err(fmt.Sprintf("reap consumers: %v\n", err))
+			}
+		}
+	}
+}
+
+func (j *Janitor) reap(ctx context.Context) error {
+	consumers, err := j.repo.Consumers(ctx, j.opts.Queue, j.opts.Group)
+	if err != nil {
+		return errors.Wrap(err, "get consumers")
+	}
+
+	var (
+		dead   []entity.ConsumerInfo
+		target entity.ConsumerInfo
+		isLive bool
+	)
+
+	for _, ci := range consumers {
+		if ci.Idle >= j.opts.MaxIdle {
+			dead = append(dead, ci)
+			continue
+		}
+
+		if !isLive || ci.Idle < target.Idle {
+			target, isLive = ci, true
+		}
+	}
+
+	for _, ci := range dead {
+		if ci.Pending > 0 {
+			if !isLive {
+				j.logger.Info(fmt.Sprintf("consumer %s has %d pending messages: no live consumers to claim them", ci.Name, ci.Pending))
+				continue
+			}
+
+			if err = j.claimPending(ctx, ci.Name, target.Name); err != nil {
+				return errors.Wrapf(err, "claim pending messages of %s", ci.Name)
+			}
+		}
+
+		removed, err := j.repo.RemoveIdleConsumer(ctx, entity.RemoveIdleConsumerDTO{
+			Queue:      j.opts.Queue,
+			Group:      j.opts.Group,
+			ConsumerID: ci.Name,
+			MinIdle:    j.opts.MaxIdle,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "remove consumer %s", ci.Name)
+		}
+
+		if removed {
+			j.logger.Info(fmt.Sprintf("consumer %s removed from group %s: idle for %s", ci.Name, j.opts.Group, ci.Idle))
+		}
+	}
+
+	return nil
+}
+
+func (j *Janitor) claimPending(ctx context.Context, from, to string) error {
+	var after string
+
+	for {
+		res, err := j.repo.ClaimPending(ctx, entity.ClaimPendingDTO{
+			Queue: j.opts.Queue,
+			Group: j.opts.Group,
+			From:  from,
+			To:    to,
+			Limit: j.opts.ClaimLimit,
+			After: after,
+		})
+		if err != nil {
+			return errors.Wrap(err, "claim pending")
+		}
+
+		if res.Last == "" {
+			return nil
+		}
+
+		after = res.Last
+
+		if res.Claimed > 0 {
+			j.logger.Info(fmt.Sprintf("%d pending messages of consumer %s claimed for %s", res.Claimed, from, to))
+		}
+	}
+}
+
+func (j *Janitor) lockKey() string {
+	return "lock:janitor:" + j.opts.Queue + ":" + j.opts.Group
+}
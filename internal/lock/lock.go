@@ -0,0 +1,187 @@
+package lock
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultTTL           = 30 * time.Second
+	defaultRetryInterval = 100 * time.Millisecond
+)
+
+var (
+	// ErrNotAcquired is returned when the lock is held by another owner.
+	ErrNotAcquired = errors.New("lock not acquired")
+	// ErrLost is returned when the lock expired or was taken by another owner.
+	ErrLost = errors.New("lock lost")
+)
+
+type repo interface {
+	SetLock(ctx context.Context, key, token string, ttl time.Duration) (bool, error)
+	ReleaseLock(ctx context.Context, key, token string) (bool, error)
+	RefreshLock(ctx context.Context, key, token string, ttl time.Duration) (bool, error)
+}
+
+// Locker acquires distributed locks. Every lock is owned by a random token,
+// so it is released and extended only by its owner.
+type Locker struct {
+	repo repo
+	opts Opts
+}
+
+type Params struct {
+	Repo repo
+
+	Opts Opts
+}
+
+type Opts struct {
+	// TTL is the lease of a lock, a lock which is not refreshed expires after it.
+	TTL time.Duration
+	// RetryInterval is the time between attempts to acquire a held lock.
+	RetryInterval time.Duration
+}
+
+func New(params Params) *Locker {
+	if params.Opts.TTL <= 0 {
+		params.Opts.TTL = defaultTTL
+	}
+
+	if params.Opts.RetryInterval <= 0 {
+		params.Opts.RetryInterval = defaultRetryInterval
+	}
+
+	return &Locker{
+		repo: params.Repo,
+		opts: params.Opts,
+	}
+}
+
+// Lock is an acquired lock.
+type Lock struct {
+	locker *Locker
+	key    string
+	token  string
+}
+
+// TryAcquire acquires the lock once and returns ErrNotAcquired if it is held.
+func (l *Locker) TryAcquire(ctx context.Context, key string) (*Lock, error) {
+	token := uuid.New().String()
+
+	ok, err := l.repo.SetLock(ctx, key, token, l.opts.TTL)
+	if err != nil {
+		return nil, errors.Wrap(err, "set lock")
+	}
+
+	if !ok {
+		return nil, ErrNotAcquired
+	}
+
+	return &Lock{locker: l, key: key, token: token}, nil
+}
+
+// Acquire waits for the lock until it is acquired, the timeout passes or ctx is done.
+// ErrNotAcquired is returned on timeout.
+func (l *Locker) Acquire(ctx context.Context, key string, timeout time.Duration) (*Lock, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		lock, err := l.TryAcquire(ctx, key)
+		if !errors.Is(err, ErrNotAcquired) {
+			return lock, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return nil, ErrNotAcquired
+		case <-time.After(l.opts.RetryInterval):
+		}
+	}
+}
+
+// Do runs f under the lock if it is not held and returns ErrNotAcquired otherwise.
+// The lease is renewed while f runs, if it is lost the context of f is canceled and ErrLost is returned.
+func (l *Locker) Do(ctx context.Context, key string, f func(ctx context.Context) error) error {
+	lock, err := l.TryAcquire(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lost := make(chan error, 1)
+	go func() {
+		lost <- lock.keepAlive(workCtx)
+		cancel()
+	}()
+
+	err = f(workCtx)
+
+	cancel()
+
+	// f stopped by the cancellation of its context reports the lost lock instead
+	if keepErr := <-lost; keepErr != nil && (err == nil || errors.Is(err, context.Canceled)) {
+		return keepErr
+	}
+
+	if releaseErr := lock.Release(context.WithoutCancel(ctx)); releaseErr != nil && err == nil {
+		return releaseErr
+	}
+
+	return err
+}
+
+// Release deletes the lock if it is still owned and returns ErrLost otherwise.
+func (l *Lock) Release(ctx context.Context) error {
+	ok, err := l.locker.repo.ReleaseLock(ctx, l.key, l.token)
+	if err != nil {
+		return errors.Wrap(err, "release lock")
+	}
+
+	if !ok {
+		return ErrLost
+	}
+
+	return nil
+}
+
+// Refresh extends the lease of the lock if it is still owned and returns ErrLost otherwise.
+func (l *Lock) Refresh(ctx context.Context) error {
+	ok, err := l.locker.repo.RefreshLock(ctx, l.key, l.token, l.locker.opts.TTL)
+	if err != nil {
+		return errors.Wrap(err, "refresh lock")
+	}
+
+	if !ok {
+		return ErrLost
+	}
+
+	return nil
+}
+
+// keepAlive refreshes the lock three times per lease until ctx is done.
+// It returns ErrLost if the lock is lost and nil when ctx is done.
+func (l *Lock) keepAlive(ctx context.Context) error {
+	ticker := time.NewTicker(l.locker.opts.TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			err := l.Refresh(ctx)
+			if errors.Is(err, ErrLost) {
+				return ErrLost
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package lock
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fakeRepo keeps the locks in memory, a lock expires after its ttl like the redis key.
+type fakeRepo struct {
+	mu        sync.Mutex
+	tokens    map[string]string
+	deadlines map[string]time.Time
+	refreshes int
+}
+
+func newFakeRepo() *fakeRepo {
+	return &fakeRepo{tokens: make(map[string]string), deadlines: make(map[string]time.Time)}
+}
+
+func (r *fakeRepo) held(key, token string) bool {
+	if time.Now().After(r.deadlines[key]) {
+		delete(r.tokens, key)
+	}
+
+	t, ok := r.tokens[key]
+
+	return ok && (token == "" || t == token)
+}
+
+func (r *fakeRepo) SetLock(_ context.Context, key, token string, ttl time.Duration) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.held(key, "") {
+		return false, nil
+	}
+
+	r.tokens[key], r.deadlines[key] = token, time.Now().Add(ttl)
+
+	return true, nil
+}
+
+func (r *fakeRepo) ReleaseLock(_ context.Context, key, token string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.held(key, token) {
+		return false, nil
+	}
+
+	delete(r.tokens, key)
+
+	return true, nil
+}
+
+func (r *fakeRepo) RefreshLock(_ context.Context, key, token string, ttl time.Duration) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.held(key, token) {
+		return false, nil
+	}
+
+	r.deadlines[key] = time.Now().Add(ttl)
+	r.refreshes++
+
+	return true, nil
+}
+
+// steal takes the lock over as another owner would after it expired.
+func (r *fakeRepo) steal(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tokens[key], r.deadlines[key] = "thief", time.Now().Add(time.Hour)
+}
+
+func TestTryAcquire(t *testing.T) {
+	ctx := context.Background()
+	l := New(Params{Repo: newFakeRepo()})
+
+	lock, err := l.TryAcquire(ctx, "k")
+	if err != nil {
+		t.Fatalf("try acquire: %v", err)
+	}
+
+	if _, err = l.TryAcquire(ctx, "k"); !errors.Is(err, ErrNotAcquired) {
+		t.Fatalf("try acquire held lock: got %v, want ErrNotAcquired", err)
+	}
+
+	if err = lock.Refresh(ctx); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	if err = lock.Release(ctx); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+
+	if err = lock.Release(ctx); !errors.Is(err, ErrLost) {
+		t.Fatalf("release released lock: got %v, want ErrLost", err)
+	}
+
+	if err = lock.Refresh(ctx); !errors.Is(err, ErrLost) {
+		t.Fatalf("refresh released lock: got %v, want ErrLost", err)
+	}
+}
+
+func TestAcquireWaits(t *testing.T) {
+	ctx := context.Background()
+	l := New(Params{Repo: newFakeRepo(), Opts: Opts{TTL: 50 * time.Millisecond, RetryInterval: 5 * time.Millisecond}})
+
+	if _, err := l.TryAcquire(ctx, "k"); err != nil {
+		t.Fatalf("try acquire: %v", err)
+	}
+
+	if _, err := l.Acquire(ctx, "k", 10*time.Millisecond); !errors.Is(err, ErrNotAcquired) {
+		t.Fatalf("acquire before the lease ends: got %v, want ErrNotAcquired", err)
+	}
+
+	// the first lock is not refreshed and expires
+	if _, err := l.Acquire(ctx, "k", time.Second); err != nil {
+		t.Fatalf("acquire after the lease ends: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err := l.Acquire(cancelled, "k", time.Second); !errors.Is(err, context.Canceled) {
+		t.Fatalf("acquire with cancelled context: got %v, want context.Canceled", err)
+	}
+}
+
+func TestDoRefreshesLease(t *testing.T) {
+	ctx := context.Background()
+	r := newFakeRepo()
+	l := New(Params{Repo: r, Opts: Opts{TTL: 30 * time.Millisecond}})
+
+	err := l.Do(ctx, "k", func(ctx context.Context) error {
+		// the work outlives several leases
+		time.Sleep(100 * time.Millisecond)
+
+		if _, err := l.TryAcquire(ctx, "k"); !errors.Is(err, ErrNotAcquired) {
+			t.Errorf("try acquire while the work runs: got %v, want ErrNotAcquired", err)
+		}
+
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("do: %v", err)
+	}
+
+	if r.refreshes == 0 {
+		t.Fatal("the lease was not refreshed")
+	}
+
+	// the lock is released after the work
+	if _, err = l.TryAcquire(ctx, "k"); err != nil {
+		t.Fatalf("try acquire after do: %v", err)
+	}
+
+	if err = l.Do(ctx, "k", func(context.Context) error { return nil }); !errors.Is(err, ErrNotAcquired) {
+		t.Fatalf("do with held lock: got %v, want ErrNotAcquired", err)
+	}
+}
+
+func TestDoLost(t *testing.T) {
+	ctx := context.Background()
+	r := newFakeRepo()
+	l := New(Params{Repo: r, Opts: Opts{TTL: 30 * time.Millisecond}})
+
+	err := l.Do(ctx, "k", func(ctx context.Context) error {
+		r.steal("k")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+			t.Error("the context of the work is not cancelled when the lock is lost")
+			return nil
+		}
+	})
+	if !errors.Is(err, ErrLost) {
+		t.Fatalf("do: got %v, want ErrLost", err)
+	}
+}
@@ -2,45 +2,287 @@ package producer
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/veleton777/redis_queue/internal/entity"
 	"github.com/veleton777/redis_queue/internal/logger"
 )
 
+const defaultMaxBatchSize = 1000
+
 type repo interface {
-	ProduceMsg(ctx context.Context, queue string, msg entity.Message) error
+	ProduceMsg(ctx context.Context, dto entity.ProduceMessageDTO) (string, error)
+	ProduceBatch(ctx context.Context, dto entity.ProduceBatchDTO) []entity.ProduceResult
+	ProduceMsgAt(ctx context.Context, queue string, msg entity.Message, at time.Time) error
+	CancelScheduled(ctx context.Context, queue, id string) (bool, error)
+	Reschedule(ctx context.Context, queue, id string, at time.Time) (bool, error)
+	ScheduledMsg(ctx context.Context, queue, id string) (entity.ScheduledMessage, bool, error)
+}
+
+type spooler interface {
+	Append(dto entity.ProduceMessageDTO) error
+	Close() error
 }
 
 type Producer struct {
 	logger logger.Logger
 	repo   repo
+	spool  spooler
 	opts   Opts
 }
 
 type Params struct {
 	Logger logger.Logger
 	Repo   repo
+	// Spool keeps messages while redis is unavailable, it is optional and closed by Close.
+	Spool spooler
 
 	Opts Opts
 }
 
 type Opts struct {
 	Queue string
+	// DedupWindow is how long a message with an idempotency key is not produced again.
+	DedupWindow time.Duration
+	// MaxBatchSize is the max number of messages sent by one pipeline, bigger batches are split.
+	MaxBatchSize int
+	// Cap limits the length of the stream, in the reject mode Produce returns entity.ErrQueueFull
+	// so the caller can back off instead of losing old entries.
+	Cap entity.StreamCap
+	// ClaimCheck offloads big payloads from the stream, consumers load them before handling.
+	ClaimCheck entity.ClaimCheckPolicy
+	// Priorities are the priorities read by consumers of the queue, messages of other priorities
+	// are rejected since nobody would read them. Empty means the normal priority only.
+	Priorities []entity.Priority
 }
 
 func New(params Params) *Producer {
+	if params.Opts.MaxBatchSize < 1 {
+		params.Opts.MaxBatchSize = defaultMaxBatchSize
+	}
+
+	if len(params.Opts.Priorities) == 0 {
+		params.Opts.Priorities = []entity.Priority{entity.PriorityNormal}
+	}
+
 	return &Producer{
 		logger: params.Logger,
 		repo:   params.Repo,
+		spool:  params.Spool,
 		opts:   params.Opts,
 	}
 }
 
-func (p *Producer) Produce(ctx context.Context, message entity.Message) error {
-	err := p.repo.ProduceMsg(ctx, p.opts.Queue, message)
+// Produce sends the message to the stream of its priority and returns its stream id.
+// If the message has an idempotency key which was produced within the dedup window,
+// nothing is sent and the stream id of the first message is returned.
+// With the spool the message is spooled if redis is unavailable and entity.ErrSpooled is returned,
+// messages produced after redis is back may overtake the spooled ones.
+func (p *Producer) Produce(ctx context.Context, evt entity.EventType, message entity.Message) (string, error) {
+	message.Type = evt
+
+	if err := p.checkPriority(message.Priority); err != nil {
+		return "", errors.Wrap(err, "check priority")
+	}
+
+	dto := p.produceDTO(message)
+
+	id, err := p.repo.ProduceMsg(ctx, dto)
+	if err != nil {
+		if p.spool != nil && errors.Is(err, entity.ErrUnavailable) {
+			return "", p.spoolMsg(dto, err)
+		}
+
+		return "", errors.Wrap(err, "produce message")
+	}
+
+	return id, nil
+}
+
+// ProduceWithPriority sends the message to the stream of the priority, e.g. urgent messages
+// to the high priority stream so they overtake the bulk ones.
+func (p *Producer) ProduceWithPriority(ctx context.Context, evt entity.EventType, priority entity.Priority, message entity.Message) (string, error) {
+	message.Priority = priority
+
+	return p.Produce(ctx, evt, message)
+}
+
+// ProduceBatch sends the messages with their own event types in pipelines of MaxBatchSize messages
+// and returns the stream id or the error of every message in the order of the messages.
+func (p *Producer) ProduceBatch(ctx context.Context, messages []entity.Message) []entity.ProduceResult {
+	results := make([]entity.ProduceResult, 0, len(messages))
+
+	for start := 0; start < len(messages); start += p.opts.MaxBatchSize {
+		batch := messages[start:min(start+p.opts.MaxBatchSize, len(messages))]
+
+		valid := make([]entity.Message, 0, len(batch))
+		batchResults := make([]entity.ProduceResult, len(batch))
+		idx := make([]int, 0, len(batch))
+
+		for i, m := range batch {
+			if err := p.checkPriority(m.Priority); err != nil {
+				batchResults[i].Err = errors.Wrap(err, "check priority")
+				continue
+			}
+
+			valid = append(valid, m)
+			idx = append(idx, i)
+		}
+
+		produced := p.repo.ProduceBatch(ctx, entity.ProduceBatchDTO{
+			Queue:       p.opts.Queue,
+			Messages:    valid,
+			DedupWindow: p.opts.DedupWindow,
+			Cap:         p.opts.Cap,
+			ClaimCheck:  p.opts.ClaimCheck,
+		})
+
+		for i, r := range produced {
+			if p.spool != nil && errors.Is(r.Err, entity.ErrUnavailable) {
+				r.Err = p.spoolMsg(p.produceDTO(valid[i]), r.Err)
+			}
+
+			batchResults[idx[i]] = r
+		}
+
+		results = append(results, batchResults...)
+	}
+
+	return results
+}
+
+// Close closes the spool, it is called once nothing produces messages anymore.
+func (p *Producer) Close() error {
+	if p.spool == nil {
+		return nil
+	}
+
+	if err := p.spool.Close(); err != nil {
+		return errors.Wrap(err, "close spool")
+	}
+
+	return nil
+}
+
+// checkPriority returns entity.ErrUnknownPriority if the priority is not read by consumers of the queue.
+func (p *Producer) checkPriority(priority entity.Priority) error {
+	parsed, err := entity.ParsePriority(string(priority))
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(p.opts.Priorities, parsed) {
+		return fmt.Errorf("%w: %s is not read by consumers of %s", entity.ErrUnknownPriority, parsed, p.opts.Queue)
+	}
+
+	return nil
+}
+
+// spoolMsg keeps the message in the spool and returns entity.ErrSpooled,
+// the produce error is returned if the spool can't take it.
+func (p *Producer) spoolMsg(dto entity.ProduceMessageDTO, produceErr error) error {
+	if err := p.spool.Append(dto); err != nil {
+		return errors.Wrapf(produceErr, "produce message, spool: %v", err)
+	}
+
+	p.logger.Info(fmt.Sprintf("msg of type %d spooled for queue %s", dto.Message.Type, dto.Queue))
+
+	return entity.ErrSpooled
+}
+
+func (p *Producer) produceDTO(message entity.Message) entity.ProduceMessageDTO {
+	return entity.ProduceMessageDTO{
+		Queue:       p.opts.Queue,
+		Message:     message,
+		DedupWindow: p.opts.DedupWindow,
+		Cap:         p.opts.Cap,
+		ClaimCheck:  p.opts.ClaimCheck,
+	}
+}
+
+// ProduceAt schedules the message, it is added to the queue at the given time by the scheduler of the queue.
+// The message is identified by its id which is generated if empty, scheduling the same id again
+// replaces the message and its time.
+func (p *Producer) ProduceAt(ctx context.Context, evt entity.EventType, message entity.Message, at time.Time) (string, error) {
+	message.Type = evt
+
+	if err := p.checkPriority(message.Priority); err != nil {
+		return "", errors.Wrap(err, "check priority")
+	}
+
+	if message.ID == "" {
+		message.ID = uuid.New().String()
+	}
+
+	err := p.repo.ProduceMsgAt(ctx, p.opts.Queue, message, at)
+	if err != nil {
+		return "", errors.Wrap(err, "produce message at")
+	}
+
+	return message.ID, nil
+}
+
+// ProduceAfter schedules the message to be added to the queue after the delay.
+func (p *Producer) ProduceAfter(ctx context.Context, evt entity.EventType, message entity.Message, delay time.Duration) (string, error) {
+	return p.ProduceAt(ctx, evt, message, time.Now().Add(delay))
+}
+
+// CancelScheduled removes the scheduled message, false is returned if it is not found or already in the queue.
+func (p *Producer) CancelScheduled(ctx context.Context, id string) (bool, error) {
+	cancelled, err := p.repo.CancelScheduled(ctx, p.opts.Queue, id)
+	if err != nil {
+		return false, errors.Wrap(err, "cancel scheduled")
+	}
+
+	return cancelled, nil
+}
+
+// Reschedule changes the time of the scheduled message, false is returned if it is not found or already in the queue.
+func (p *Producer) Reschedule(ctx context.Context, id string, at time.Time) (bool, error) {
+	rescheduled, err := p.repo.Reschedule(ctx, p.opts.Queue, id, at)
+	if err != nil {
+		return false, errors.Wrap(err, "reschedule")
+	}
+
+	return rescheduled, nil
+}
+
+func (p *Producer) Scheduled(ctx context.Context, id string) (entity.ScheduledMessage, bool, error) {
+	m, found, err := p.repo.ScheduledMsg(ctx, p.opts.Queue, id)
+	if err != nil {
+		return entity.ScheduledMessage{}, false, errors.Wrap(err, "get scheduled message")
+	}
+
+	return m, found, nil
+}
+
+// Produce marshals the payload to json and sends it to the queue as a message of the event type.
+// The codec of the queue encodes the message with the json payload in it, not the payload itself,
+// so handlers registered by handler.RegisterHandler decode it whatever codec the message has.
+func Produce[T any](ctx context.Context, p *Producer, evt entity.EventType, payload T) error {
+	return ProduceOnce(ctx, p, evt, "", payload)
+}
+
+// ProduceOnce is Produce with the idempotency key, the payload is not sent again with the same key
+// within the dedup window. An empty key disables deduplication.
+func ProduceOnce[T any](ctx context.Context, p *Producer, evt entity.EventType, idempotencyKey string, payload T) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "json marshal payload")
+	}
+
+	_, err = p.Produce(ctx, evt, entity.Message{
+		ID:             uuid.New().String(),
+		Payload:        string(b),
+		IdempotencyKey: idempotencyKey,
+	})
 	if err != nil {
-		return errors.Wrap(err, "produce message")
+		return errors.Wrap(err, "produce")
 	}
 
 	return nil
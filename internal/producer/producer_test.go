@@ -0,0 +1,212 @@
+package producer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+// fakeRepo records produced messages, the methods a test does not expect panic on the nil repo.
+type fakeRepo struct {
+	repo
+
+	mu        sync.Mutex
+	err       error
+	produced  []entity.ProduceMessageDTO
+	scheduled []entity.ScheduledMessage
+}
+
+func (r *fakeRepo) ProduceMsg(_ context.Context, dto entity.ProduceMessageDTO) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return "", r.err
+	}
+
+	r.produced = append(r.produced, dto)
+
+	return "1-0", nil
+}
+
+func (r *fakeRepo) ProduceBatch(_ context.Context, dto entity.ProduceBatchDTO) []entity.ProduceResult {
+	results := make([]entity.ProduceResult, len(dto.Messages))
+	for i := range results {
+		results[i].ID = "1-0"
+	}
+
+	return results
+}
+
+func (r *fakeRepo) ProduceMsgAt(_ context.Context, queue string, msg entity.Message, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.scheduled = append(r.scheduled, entity.ScheduledMessage{Message: msg, At: at})
+
+	return nil
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Err(string)     {}
+func (nopLogger) Info(string)    {}
+func (nopLogger) Success(string) {}
+
+func TestProduceChecksPriority(t *testing.T) {
+	ctx := context.Background()
+	r := &fakeRepo{}
+	p := New(Params{Logger: nopLogger{}, Repo: r, Opts: Opts{
+		Queue:      "q",
+		Priorities: []entity.Priority{entity.PriorityHigh, entity.PriorityLow},
+	}})
+
+	if _, err := p.ProduceWithPriority(ctx, entity.EventTypeUser, entity.PriorityHigh, entity.Message{}); err != nil {
+		t.Fatalf("produce with a read priority: %v", err)
+	}
+
+	for _, priority := range []entity.Priority{"", entity.PriorityNormal, "urgent"} {
+		_, err := p.ProduceWithPriority(ctx, entity.EventTypeUser, priority, entity.Message{})
+		if !errors.Is(err, entity.ErrUnknownPriority) {
+			t.Fatalf("produce with priority %q: got %v, want ErrUnknownPriority", priority, err)
+		}
+	}
+
+	results := p.ProduceBatch(ctx, []entity.Message{{Priority: entity.PriorityLow}, {Priority: entity.PriorityNormal}})
+	if results[0].Err != nil || !errors.Is(results[1].Err, entity.ErrUnknownPriority) {
+		t.Fatalf("batch results: %+v", results)
+	}
+
+	if len(r.produced) != 1 {
+		t.Fatalf("got %d produced messages, want 1", len(r.produced))
+	}
+}
+
+func TestProduceDefaultPriority(t *testing.T) {
+	p := New(Params{Logger: nopLogger{}, Repo: &fakeRepo{}, Opts: Opts{Queue: "q"}})
+
+	if _, err := p.Produce(context.Background(), entity.EventTypeUser, entity.Message{}); err != nil {
+		t.Fatalf("produce with the normal priority: %v", err)
+	}
+
+	_, err := p.ProduceWithPriority(context.Background(), entity.EventTypeUser, entity.PriorityHigh, entity.Message{})
+	if !errors.Is(err, entity.ErrUnknownPriority) {
+		t.Fatalf("produce with a priority of no stream: got %v, want ErrUnknownPriority", err)
+	}
+}
+
+type fakeSpool struct {
+	spooled []entity.ProduceMessageDTO
+	closed  bool
+}
+
+func (s *fakeSpool) Append(dto entity.ProduceMessageDTO) error {
+	if s.closed {
+		return errors.New("closed")
+	}
+
+	s.spooled = append(s.spooled, dto)
+
+	return nil
+}
+
+func (s *fakeSpool) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestProduceSpoolsOnlyWhileUnavailable(t *testing.T) {
+	ctx := context.Background()
+	r := &fakeRepo{err: entity.ErrUnavailable}
+	s := &fakeSpool{}
+	p := New(Params{Logger: nopLogger{}, Repo: r, Spool: s, Opts: Opts{Queue: "q"}})
+
+	if id, err := p.Produce(ctx, entity.EventTypeUser, entity.Message{Payload: "1"}); !errors.Is(err, entity.ErrSpooled) || id != "" {
+		t.Fatalf("produce while redis is unavailable: got %v, id %q, want ErrSpooled", err, id)
+	}
+
+	r.err = nil
+
+	// spooled messages are replayed in the background, new ones go to redis right away
+	if id, err := p.Produce(ctx, entity.EventTypeUser, entity.Message{Payload: "2"}); err != nil || id == "" {
+		t.Fatalf("produce after redis is back: %v, id %q", err, id)
+	}
+
+	if len(s.spooled) != 1 || len(r.produced) != 1 {
+		t.Fatalf("got %d spooled and %d produced messages, want 1 and 1", len(s.spooled), len(r.produced))
+	}
+
+	if err := p.Close(); err != nil || !s.closed {
+		t.Fatalf("close: %v, spool closed %t", err, s.closed)
+	}
+
+	r.err = entity.ErrUnavailable
+
+	if _, err := p.Produce(ctx, entity.EventTypeUser, entity.Message{Payload: "3"}); !errors.Is(err, entity.ErrUnavailable) {
+		t.Fatalf("produce after close: got %v, want the produce error", err)
+	}
+}
+
+func TestProduceAt(t *testing.T) {
+	ctx := context.Background()
+	r := &fakeRepo{}
+	p := New(Params{Logger: nopLogger{}, Repo: r, Opts: Opts{Queue: "q"}})
+
+	at := time.Now().Add(time.Hour)
+
+	id, err := p.ProduceAt(ctx, entity.EventTypeUser, entity.Message{Payload: "p"}, at)
+	if err != nil || id == "" {
+		t.Fatalf("produce at: %v, id %q", err, id)
+	}
+
+	if _, err = p.ProduceAt(ctx, entity.EventTypeUser, entity.Message{ID: "given"}, at); err != nil {
+		t.Fatalf("produce at with id: %v", err)
+	}
+
+	before := time.Now()
+
+	if _, err = p.ProduceAfter(ctx, entity.EventTypeUser, entity.Message{}, time.Minute); err != nil {
+		t.Fatalf("produce after: %v", err)
+	}
+
+	if _, err = p.ProduceAt(ctx, entity.EventTypeUser, entity.Message{Priority: entity.PriorityHigh}, at); !errors.Is(err, entity.ErrUnknownPriority) {
+		t.Fatalf("produce at with unknown priority: got %v, want ErrUnknownPriority", err)
+	}
+
+	if len(r.scheduled) != 3 {
+		t.Fatalf("got %d scheduled messages, want 3", len(r.scheduled))
+	}
+
+	first, second, third := r.scheduled[0], r.scheduled[1], r.scheduled[2]
+
+	if first.Message.ID != id || first.Message.Type != entity.EventTypeUser || !first.At.Equal(at) {
+		t.Fatalf("first scheduled message: %+v", first)
+	}
+
+	if second.Message.ID != "given" {
+		t.Fatalf("second scheduled message id: got %q, want given", second.Message.ID)
+	}
+
+	if third.At.Before(before.Add(time.Minute)) || third.At.After(time.Now().Add(time.Minute)) {
+		t.Fatalf("produce after a minute scheduled at %s", third.At)
+	}
+}
+
+func TestProduceDoesNotSpoolCancelled(t *testing.T) {
+	ctx := context.Background()
+	r := &fakeRepo{err: errors.Wrap(context.DeadlineExceeded, "redis produce script")}
+	s := &fakeSpool{}
+	p := New(Params{Logger: nopLogger{}, Repo: r, Spool: s, Opts: Opts{Queue: "q"}})
+
+	if _, err := p.Produce(ctx, entity.EventTypeUser, entity.Message{Payload: "1"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("produce after timeout: got %v, want the produce error", err)
+	}
+
+	if len(s.spooled) != 0 {
+		t.Fatalf("got %d spooled messages, want 0", len(s.spooled))
+	}
+}
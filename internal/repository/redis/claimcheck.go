@@ -0,0 +1,151 @@
+package redis
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/redis/rueidis"
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+const (
+	blobDataField = "data"
+	// blobRetriesField counts the retry copies referring to the payload which are not done yet.
+	blobRetriesField = "retries"
+)
+
+// releasePayloadLua defines releasePayload for the scripts acking messages offloaded by claim-check.
+// releasePayload(stream, blob, id, retry) is called once the XACK of the group removed the message,
+// a retry copy drops its reference first. The payload is deleted when there are no retry copies left
+// and no group of the stream still has to read or ack the original message id.
+const releasePayloadLua = `
+local function parseID(id)
+	local ms, seq = string.match(id, '^(%d+)-?(%d*)$')
+
+	return tonumber(ms), tonumber(seq) or 0
+end
+
+local function idBefore(a, b)
+	local ams, aseq = parseID(a)
+	local bms, bseq = parseID(b)
+	if not ams or not bms then
+		return false
+	end
+
+	if ams ~= bms then
+		return ams < bms
+	end
+
+	return aseq < bseq
+end
+
+local function releasePayload(stream, blob, id, retry)
+	if blob == '' or redis.call('EXISTS', blob) == 0 then
+		return
+	end
+
+	if retry then
+		if redis.call('HINCRBY', blob, '` + blobRetriesField + `', -1) > 0 then
+			return
+		end
+	elseif tonumber(redis.call('HGET', blob, '` + blobRetriesField + `') or '0') > 0 then
+		return
+	end
+
+	for _, g in ipairs(redis.call('XINFO', 'GROUPS', stream)) do
+		local info = {}
+		for i = 1, #g, 2 do
+			info[g[i]] = g[i + 1]
+		end
+
+		if idBefore(info['last-delivered-id'], id) then
+			return
+		end
+
+		if #redis.call('XPENDING', stream, info['name'], id, id, 1) > 0 then
+			return
+		end
+	end
+
+	redis.call('DEL', blob)
+end
+`
+
+// ackClaimCheckScript acks the message offloaded by claim-check and releases its payload,
+// nothing is released if the message was already acked, e.g. by another consumer which reclaimed it.
+var ackClaimCheckScript = rueidis.NewLuaScript(releasePayloadLua + `
+if redis.call('XACK', KEYS[1], ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+
+redis.call('HDEL', KEYS[2], ARGV[2])
+releasePayload(KEYS[1], KEYS[3], ARGV[3], ARGV[4] == '1')
+
+return 1
+`)
+
+// LoadPayloads fills the payloads of the messages offloaded by claim-check in one pipeline,
+// payloads which expired are left empty.
+func (r *Repo) LoadPayloads(ctx context.Context, messages []entity.Message) error {
+	cmds := make(rueidis.Commands, 0, len(messages))
+	idx := make([]int, 0, len(messages))
+
+	for i, m := range messages {
+		if m.ClaimCheck == "" || m.Payload != "" {
+			continue
+		}
+
+		cmds = append(cmds, r.rdb.B().Hget().Key(m.ClaimCheck).Field(blobDataField).Build())
+		idx = append(idx, i)
+	}
+
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	for i, resp := range r.rdb.DoMulti(ctx, cmds...) {
+		payload, err := resp.ToString()
+		if rueidis.IsRedisNil(err) {
+			continue
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "redis hGet")
+		}
+
+		messages[idx[i]].Payload = payload
+	}
+
+	return nil
+}
+
+// AckClaimCheck acks the message offloaded by claim-check in the group, the payload is deleted
+// when no group of the queue and no retry copy needs it anymore.
+func (r *Repo) AckClaimCheck(ctx context.Context, group string, m entity.Message) error {
+	err := ackClaimCheckScript.Exec(
+		ctx,
+		r.rdb,
+		[]string{m.Queue, errorsKey(m.Queue, group), m.ClaimCheck},
+		[]string{group, m.ID, m.SourceID(), retryFlag(m)},
+	).Error()
+	if err != nil {
+		return errors.Wrap(err, "redis ack claim-check script")
+	}
+
+	return nil
+}
+
+// retryFlag tells releasePayload whether the message is a retry copy holding a reference to the payload.
+func retryFlag(m entity.Message) string {
+	if m.RetryGroup != "" {
+		return "1"
+	}
+
+	return "0"
+}
+
+// blobKey is a new key for an offloaded payload of the queue.
+func blobKey(queue string) string {
+	return queue + ":blob:" + uuid.New().String()
+}
@@ -0,0 +1,176 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+var testClaimCheck = entity.ClaimCheckPolicy{Threshold: 1, TTL: time.Minute}
+
+// produceOffloaded produces the message with the offloaded payload and reads it in every group.
+func produceOffloaded(t *testing.T, r *Repo, queue string, groups ...string) []entity.Message {
+	t.Helper()
+
+	ctx := context.Background()
+
+	if _, err := r.ProduceMsg(ctx, entity.ProduceMessageDTO{Queue: queue, Message: entity.Message{Type: 1, Payload: "payload"}, ClaimCheck: testClaimCheck}); err != nil {
+		t.Fatalf("produce: %v", err)
+	}
+
+	messages := make([]entity.Message, 0, len(groups))
+
+	for _, g := range groups {
+		read, err := r.Messages(ctx, entity.GetMessagesDTO{ConsumerID: "c", Queues: []string{queue}, Group: g, Limit: 1})
+		if err != nil || len(read) != 1 {
+			t.Fatalf("read messages of %s: %v, %d messages", g, err, len(read))
+		}
+
+		if read[0].ClaimCheck == "" || read[0].Payload != "" {
+			t.Fatalf("payload is not offloaded: %+v", read[0])
+		}
+
+		messages = append(messages, read[0])
+	}
+
+	return messages
+}
+
+func assertBlob(t *testing.T, r *Repo, blob string, want bool) {
+	t.Helper()
+
+	n, err := r.rdb.Do(context.Background(), r.rdb.B().Exists().Key(blob).Build()).AsInt64()
+	if err != nil || (n == 1) != want {
+		t.Fatalf("blob %s: %v, exists %v, want %v", blob, err, n == 1, want)
+	}
+}
+
+func TestAckClaimCheckReleasesWithLastGroup(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	const queue = "q"
+
+	for _, g := range []string{"g1", "g2"} {
+		if err := r.RegisterConsumer(ctx, queue, g, "c"); err != nil {
+			t.Fatalf("register consumer: %v", err)
+		}
+	}
+
+	messages := produceOffloaded(t, r, queue, "g1", "g2")
+	blob := messages[0].ClaimCheck
+
+	if err := r.AckClaimCheck(ctx, "g1", messages[0]); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+
+	assertBlob(t, r, blob, true)
+
+	// the second ack of a reclaimed message does not release the payload of another group
+	if err := r.AckClaimCheck(ctx, "g1", messages[0]); err != nil {
+		t.Fatalf("ack again: %v", err)
+	}
+
+	assertBlob(t, r, blob, true)
+
+	if err := r.AckClaimCheck(ctx, "g2", messages[1]); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+
+	assertBlob(t, r, blob, false)
+}
+
+func TestAckClaimCheckKeepsPayloadForLateGroup(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	const queue = "q"
+
+	if err := r.RegisterConsumer(ctx, queue, "g1", "c"); err != nil {
+		t.Fatalf("register consumer: %v", err)
+	}
+
+	messages := produceOffloaded(t, r, queue, "g1")
+	blob := messages[0].ClaimCheck
+
+	// the group is created after the message was produced and reads the stream from the beginning
+	if err := r.rdb.Do(ctx, r.rdb.B().XgroupCreate().Key(queue).Group("g2").Id("0").Build()).Error(); err != nil {
+		t.Fatalf("xGroupCreate: %v", err)
+	}
+
+	if err := r.AckClaimCheck(ctx, "g1", messages[0]); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+
+	assertBlob(t, r, blob, true)
+
+	late, err := r.Messages(ctx, entity.GetMessagesDTO{ConsumerID: "c", Queues: []string{queue}, Group: "g2", Limit: 1})
+	if err != nil || len(late) != 1 {
+		t.Fatalf("read messages of the late group: %v, %d messages", err, len(late))
+	}
+
+	assertBlob(t, r, blob, true)
+
+	if err = r.AckClaimCheck(ctx, "g2", late[0]); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+
+	assertBlob(t, r, blob, false)
+}
+
+func TestClaimCheckKeptForRetry(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	const queue, group = "q", "g"
+
+	if err := r.RegisterConsumer(ctx, queue, group, "c"); err != nil {
+		t.Fatalf("register consumer: %v", err)
+	}
+
+	m := produceOffloaded(t, r, queue, group)[0]
+
+	retry := m
+	retry.ID = "retry"
+	retry.RetryGroup = group
+	retry.OriginID = m.ID
+
+	scheduled, err := r.RetryMessage(ctx, entity.RetryMessageDTO{
+		Queue:       queue,
+		Group:       group,
+		SourceQueue: queue,
+		SourceID:    m.ID,
+		Message:     retry,
+		At:          time.Now(),
+	})
+	if err != nil || !scheduled {
+		t.Fatalf("retry: %v, scheduled %v", err, scheduled)
+	}
+
+	// the original is acked, the payload is kept for the retry
+	assertBlob(t, r, m.ClaimCheck, true)
+
+	if pending := pendingCount(t, r, queue, group); pending != 0 {
+		t.Fatalf("%d pending messages after retry, want 0", pending)
+	}
+
+	// the retry is delivered as a new stream entry
+	if err = r.rdb.Do(ctx, r.rdb.B().Xadd().Key(queue).Id("*").FieldValue().FieldValue(dataField, "{}").Build()).Error(); err != nil {
+		t.Fatalf("xAdd: %v", err)
+	}
+
+	read, err := r.Messages(ctx, entity.GetMessagesDTO{ConsumerID: "c", Queues: []string{queue}, Group: group, Limit: 1})
+	if err != nil || len(read) != 1 {
+		t.Fatalf("read retry: %v, %d messages", err, len(read))
+	}
+
+	retry.ID, retry.Queue = read[0].ID, queue
+
+	if err = r.DeadLetterMessage(ctx, entity.DeadLetterMessageDTO{Queue: queue, Group: group, ConsumerID: "c", Message: retry, Reason: "failed"}); err != nil {
+		t.Fatalf("dead letter: %v", err)
+	}
+
+	assertBlob(t, r, m.ClaimCheck, false)
+}
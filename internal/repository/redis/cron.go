@@ -0,0 +1,99 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/redis/rueidis"
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+// fireCronJobScript adds the message of the job for the tick and the missed ticks if they must be
+// caught up, unless the tick is already fired. The last fired tick is saved in the same step,
+// so every tick is fired once however many instances run the job. A stream without consumer groups
+// is not fired into and the tick is left unfired: no consumer would read the message.
+// The header pairs of the message follow its data in ARGV[5].
+var fireCronJobScript = rueidis.NewLuaScript(`
+local tick = tonumber(ARGV[1])
+local every = tonumber(ARGV[2])
+local last = tonumber(redis.call('GET', KEYS[1]) or '0')
+
+if last >= tick then
+	return 0
+end
+
+if redis.call('EXISTS', KEYS[2]) == 0 or #redis.call('XINFO', 'GROUPS', KEYS[2]) == 0 then
+	return redis.error_reply('` + errNoReader + `')
+end
+
+local from = tick
+if ARGV[3] == '1' and last > 0 then
+	from = math.max(last + every, tick - (tonumber(ARGV[4]) - 1) * every)
+end
+
+local fields = {'` + dataField + `', ARGV[5]}
+for i = 6, #ARGV do
+	fields[#fields + 1] = ARGV[i]
+end
+
+local fired = 0
+for t = from, tick, every do
+	redis.call('XADD', KEYS[2], '*', unpack(fields))
+	fired = fired + 1
+end
+
+redis.call('SET', KEYS[1], ARGV[1])
+
+return fired
+`)
+
+// errNoReader is the error reply of fireCronJobScript for a stream without consumer groups.
+const errNoReader = "NOREADER stream has no consumer groups"
+
+// FireCronJob adds the message of the job to the stream of its priority if the tick has not been fired yet
+// and returns how many messages were added, entity.ErrNoReader is returned if the stream has no consumer groups.
+func (r *Repo) FireCronJob(ctx context.Context, dto entity.FireCronJobDTO) (int64, error) {
+	data, headers, err := r.encode(dto.Queue, dto.Message)
+	if err != nil {
+		return 0, err
+	}
+
+	catchUp := "0"
+	if dto.CatchUp {
+		catchUp = "1"
+	}
+
+	maxCatchUp := dto.MaxCatchUp
+	if maxCatchUp < 1 {
+		maxCatchUp = 1
+	}
+
+	fired, err := fireCronJobScript.Exec(
+		ctx,
+		r.rdb,
+		[]string{cronKey(dto.Name), PriorityQueue(dto.Queue, dto.Message.Priority)},
+		append([]string{
+			strconv.FormatInt(dto.Tick.UnixMilli(), 10),
+			strconv.FormatInt(dto.Every.Milliseconds(), 10),
+			catchUp,
+			strconv.Itoa(maxCatchUp),
+			data,
+		}, headers...),
+	).AsInt64()
+	if err != nil {
+		if strings.Contains(err.Error(), errNoReader) {
+			return 0, entity.ErrNoReader
+		}
+
+		return 0, errors.Wrap(err, "redis fire cron job script")
+	}
+
+	return fired, nil
+}
+
+// cronKey keeps the last fired tick of the job in unix ms.
+func cronKey(name string) string {
+	return "cron:" + name
+}
@@ -0,0 +1,90 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+func TestFireCronJob(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	if err := r.RegisterConsumer(ctx, "q", "g", "c"); err != nil {
+		t.Fatalf("register consumer: %v", err)
+	}
+
+	const every = time.Minute
+
+	start := time.UnixMilli(1_700_000_040_000)
+
+	cases := []struct {
+		name       string
+		tick       time.Time
+		catchUp    bool
+		maxCatchUp int
+		want       int64
+	}{
+		{name: "first tick", tick: start, catchUp: true, maxCatchUp: 10, want: 1},
+		{name: "the same tick", tick: start, catchUp: true, maxCatchUp: 10, want: 0},
+		{name: "an earlier tick", tick: start.Add(-every), catchUp: true, maxCatchUp: 10, want: 0},
+		{name: "missed ticks skipped", tick: start.Add(5 * every), want: 1},
+		{name: "missed ticks caught up", tick: start.Add(10 * every), catchUp: true, maxCatchUp: 10, want: 5},
+		{name: "catch up limited", tick: start.Add(20 * every), catchUp: true, maxCatchUp: 3, want: 3},
+		{name: "zero catch up fires the tick", tick: start.Add(30 * every), catchUp: true, want: 1},
+	}
+
+	var total int64
+
+	for _, c := range cases {
+		fired, err := r.FireCronJob(ctx, entity.FireCronJobDTO{
+			Name:       "job",
+			Queue:      "q",
+			Tick:       c.tick,
+			Every:      every,
+			CatchUp:    c.catchUp,
+			MaxCatchUp: c.maxCatchUp,
+			Message:    entity.Message{Type: 1, Payload: "p"},
+		})
+		if err != nil || fired != c.want {
+			t.Fatalf("%s: %v, fired %d times, want %d", c.name, err, fired, c.want)
+		}
+
+		total += fired
+	}
+
+	assertLen(t, r, "q", total)
+}
+
+func TestFireCronJobWithoutReader(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	if err := r.RegisterConsumer(ctx, "q", "g", "c"); err != nil {
+		t.Fatalf("register consumer: %v", err)
+	}
+
+	dto := entity.FireCronJobDTO{
+		Name:    "job",
+		Queue:   "q",
+		Tick:    time.UnixMilli(1_700_000_040_000),
+		Every:   time.Minute,
+		Message: entity.Message{Type: 1, Payload: "p", Priority: entity.PriorityHigh},
+	}
+
+	if _, err := r.FireCronJob(ctx, dto); !errors.Is(err, entity.ErrNoReader) {
+		t.Fatalf("fire into the high priority stream: got %v, want ErrNoReader", err)
+	}
+
+	dto.Message.Priority = entity.PriorityNormal
+
+	fired, err := r.FireCronJob(ctx, dto)
+	if err != nil || fired != 1 {
+		t.Fatalf("fire the tick left unfired: %v, fired %d times", err, fired)
+	}
+
+	assertLen(t, r, "q", 1)
+}
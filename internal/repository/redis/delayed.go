@@ -0,0 +1,286 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/rueidis"
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+// scheduleScript saves the data of the delayed message and schedules its id, scheduling an existing id
+// replaces its data and time.
+var scheduleScript = rueidis.NewLuaScript(`
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+
+return 1
+`)
+
+// promoteDelayedScript moves due messages of the delayed queue into the streams of their priorities,
+// XADD and removal of every message are done in one step. Members without saved data
+// were scheduled before messages got ids and hold the data themselves. The data is the list
+// of the priority and the entry fields (see encodeItem), messages scheduled before headers were added
+// hold the message json. Data which can't be split is moved to KEYS[3] by its id, so it does not
+// stop the promotion. KEYS[4] is the stream of the normal priority which also takes messages
+// of unknown priorities, the streams of the priorities in ARGV[3..] follow it.
+var promoteDelayedScript = rueidis.NewLuaScript(`
+local streams = {}
+for i = 4, #KEYS do
+	streams[ARGV[i - 1]] = KEYS[i]
+end
+
+local function jsonPriority(data)
+	local ok, msg = pcall(cjson.decode, data)
+	if ok and type(msg) == 'table' then
+		return msg['priority']
+	end
+end
+
+local function splitItem(data)
+	local parts, pos = {}, 1
+	while pos <= #data do
+		local colon = string.find(data, ':', pos, true)
+		if not colon then
+			return nil
+		end
+
+		local size = string.sub(data, pos, colon - 1)
+		if not string.match(size, '^%d+$') or colon + tonumber(size) > #data then
+			return nil
+		end
+
+		parts[#parts + 1] = string.sub(data, colon + 1, colon + tonumber(size))
+		pos = colon + tonumber(size) + 1
+	end
+
+	if #parts < 3 or #parts % 2 == 0 then
+		return nil
+	end
+
+	return parts
+end
+
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+local promoted = 0
+
+for _, id in ipairs(ids) do
+	local data = redis.call('HGET', KEYS[2], id)
+	if not data then
+		data = id
+	end
+
+	local fields, priority
+
+	if string.sub(data, 1, 1) == '{' then
+		fields = {'` + dataField + `', data}
+		priority = jsonPriority(data)
+	else
+		local parts = splitItem(data)
+		if parts then
+			priority = parts[1]
+			fields = {}
+			for i = 2, #parts do
+				fields[#fields + 1] = parts[i]
+			end
+		end
+	end
+
+	if fields then
+		local stream = KEYS[4]
+		if streams[priority] then
+			stream = streams[priority]
+		end
+
+		redis.call('XADD', stream, '*', unpack(fields))
+		promoted = promoted + 1
+	else
+		redis.call('HSET', KEYS[3], id, data)
+	end
+
+	redis.call('ZREM', KEYS[1], id)
+	redis.call('HDEL', KEYS[2], id)
+end
+
+return promoted
+`)
+
+// retryScript acks the failed message in the group and schedules its copy in one step. Nothing is
+// scheduled if the message was already acked, e.g. by another consumer which reclaimed it.
+// The copy holds a reference to the payload offloaded by claim-check in KEYS[5],
+// a copy of a retry copy takes over its reference.
+var retryScript = rueidis.NewLuaScript(`
+if redis.call('XACK', KEYS[3], ARGV[4], ARGV[5]) == 0 then
+	return 0
+end
+
+redis.call('HDEL', KEYS[4], ARGV[5])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+
+if KEYS[5] ~= '' and ARGV[6] ~= 'true' and redis.call('EXISTS', KEYS[5]) == 1 then
+	redis.call('HINCRBY', KEYS[5], '` + blobRetriesField + `', 1)
+end
+
+return 1
+`)
+
+var cancelScheduledScript = rueidis.NewLuaScript(`
+redis.call('HDEL', KEYS[2], ARGV[1])
+
+return redis.call('ZREM', KEYS[1], ARGV[1])
+`)
+
+var rescheduleScript = rueidis.NewLuaScript(`
+if not redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return 0
+end
+
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+
+return 1
+`)
+
+// ProduceMsgAt adds the message to the delayed queue by its id, it is moved into the queue at the given time.
+func (r *Repo) ProduceMsgAt(ctx context.Context, queue string, msg entity.Message, at time.Time) error {
+	item, err := r.encodeItem(queue, msg)
+	if err != nil {
+		return errors.Wrap(err, "encode item")
+	}
+
+	err = scheduleScript.Exec(
+		ctx,
+		r.rdb,
+		[]string{delayedKey(queue), delayedItemsKey(queue)},
+		[]string{msg.ID, item, strconv.FormatInt(at.UnixMilli(), 10)},
+	).Error()
+	if err != nil {
+		return errors.Wrap(err, "redis schedule script")
+	}
+
+	return nil
+}
+
+// RetryMessage acks the failed message in the group and schedules dto.Message instead of it,
+// false is returned if the failed message was already acked and nothing was scheduled.
+func (r *Repo) RetryMessage(ctx context.Context, dto entity.RetryMessageDTO) (bool, error) {
+	item, err := r.encodeItem(dto.Queue, dto.Message)
+	if err != nil {
+		return false, errors.Wrap(err, "encode item")
+	}
+
+	scheduled, err := retryScript.Exec(
+		ctx,
+		r.rdb,
+		[]string{delayedKey(dto.Queue), delayedItemsKey(dto.Queue), dto.SourceQueue, errorsKey(dto.SourceQueue, dto.Group), dto.Message.ClaimCheck},
+		[]string{dto.Message.ID, item, strconv.FormatInt(dto.At.UnixMilli(), 10), dto.Group, dto.SourceID, strconv.FormatBool(dto.SourceRetry)},
+	).AsInt64()
+	if err != nil {
+		return false, errors.Wrap(err, "redis retry script")
+	}
+
+	return scheduled == 1, nil
+}
+
+// CancelScheduled removes the delayed message, false is returned if there is no such message.
+func (r *Repo) CancelScheduled(ctx context.Context, queue, id string) (bool, error) {
+	removed, err := cancelScheduledScript.Exec(
+		ctx,
+		r.rdb,
+		[]string{delayedKey(queue), delayedItemsKey(queue)},
+		[]string{id},
+	).AsInt64()
+	if err != nil {
+		return false, errors.Wrap(err, "redis cancel scheduled script")
+	}
+
+	return removed == 1, nil
+}
+
+// Reschedule changes the time of the delayed message, false is returned if there is no such message.
+func (r *Repo) Reschedule(ctx context.Context, queue, id string, at time.Time) (bool, error) {
+	updated, err := rescheduleScript.Exec(
+		ctx,
+		r.rdb,
+		[]string{delayedKey(queue)},
+		[]string{id, strconv.FormatInt(at.UnixMilli(), 10)},
+	).AsInt64()
+	if err != nil {
+		return false, errors.Wrap(err, "redis reschedule script")
+	}
+
+	return updated == 1, nil
+}
+
+// ScheduledMsg returns the delayed message by its id, false is returned if there is no such message.
+func (r *Repo) ScheduledMsg(ctx context.Context, queue, id string) (entity.ScheduledMessage, bool, error) {
+	resps := r.rdb.DoMulti(
+		ctx,
+		r.rdb.B().Zscore().Key(delayedKey(queue)).Member(id).Build(),
+		r.rdb.B().Hget().Key(delayedItemsKey(queue)).Field(id).Build(),
+	)
+
+	score, err := resps[0].AsFloat64()
+	if rueidis.IsRedisNil(err) {
+		return entity.ScheduledMessage{}, false, nil
+	}
+	if err != nil {
+		return entity.ScheduledMessage{}, false, errors.Wrap(err, "redis zScore")
+	}
+
+	data, err := resps[1].ToString()
+	if rueidis.IsRedisNil(err) {
+		return entity.ScheduledMessage{}, false, nil
+	}
+	if err != nil {
+		return entity.ScheduledMessage{}, false, errors.Wrap(err, "redis hGet")
+	}
+
+	m, err := decodeItem(data)
+	if err != nil {
+		return entity.ScheduledMessage{}, false, errors.Wrap(err, "decode item")
+	}
+
+	return entity.ScheduledMessage{
+		Message: m,
+		At:      time.UnixMilli(int64(score)),
+	}, true, nil
+}
+
+// PromoteDelayed moves up to dto.Limit delayed messages due by dto.Until into the queue
+// and returns how many of them were moved.
+func (r *Repo) PromoteDelayed(ctx context.Context, dto entity.PromoteDelayedDTO) (int64, error) {
+	keys := []string{delayedKey(dto.Queue), delayedItemsKey(dto.Queue), delayedMalformedKey(dto.Queue), dto.Queue}
+	args := []string{strconv.FormatInt(dto.Until.UnixMilli(), 10), strconv.Itoa(dto.Limit), string(entity.PriorityNormal)}
+
+	for _, p := range entity.Priorities {
+		if p != entity.PriorityNormal {
+			keys = append(keys, PriorityQueue(dto.Queue, p))
+			args = append(args, string(p))
+		}
+	}
+
+	promoted, err := promoteDelayedScript.Exec(ctx, r.rdb, keys, args).AsInt64()
+	if err != nil {
+		return 0, errors.Wrap(err, "redis promote delayed script")
+	}
+
+	return promoted, nil
+}
+
+// delayedKey is the sorted set of ids of messages waiting to be added to the queue scored by unix ms.
+func delayedKey(queue string) string {
+	return queue + ":delayed"
+}
+
+// delayedItemsKey is the hash of data of the delayed messages by their ids.
+func delayedItemsKey(queue string) string {
+	return queue + ":delayed:items"
+}
+
+// delayedMalformedKey keeps the data of delayed messages which can't be promoted by their ids.
+func delayedMalformedKey(queue string) string {
+	return queue + ":delayed:malformed"
+}
@@ -0,0 +1,310 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/veleton777/redis_queue/internal/codec"
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+func TestPromoteDelayedToPriorityStreams(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	const queue = "q"
+
+	for _, m := range []entity.Message{
+		{ID: "1", Type: 1, Payload: "p", Priority: entity.PriorityHigh},
+		{ID: "2", Type: 1, Payload: "p"},
+		{ID: "3", Type: 1, Payload: "p", Priority: "unknown"},
+	} {
+		if err := r.ProduceMsgAt(ctx, queue, m, time.UnixMilli(1)); err != nil {
+			t.Fatalf("produce at: %v", err)
+		}
+	}
+
+	// items saved before headers were added hold the message json
+	items := map[string]string{
+		"4": `{"id":"4","type":1,"payload":"p","priority":"low"}`,
+		"5": `{"id":"5","type":1,"payload":"p","priority":"unknown"}`,
+	}
+
+	for id, item := range items {
+		if err := r.rdb.Do(ctx, r.rdb.B().Hset().Key(delayedItemsKey(queue)).FieldValue().FieldValue(id, item).Build()).Error(); err != nil {
+			t.Fatalf("hSet: %v", err)
+		}
+
+		if err := r.rdb.Do(ctx, r.rdb.B().Zadd().Key(delayedKey(queue)).ScoreMember().ScoreMember(1, id).Build()).Error(); err != nil {
+			t.Fatalf("zAdd: %v", err)
+		}
+	}
+
+	promoted, err := r.PromoteDelayed(ctx, entity.PromoteDelayedDTO{Queue: queue, Until: time.Now(), Limit: 10})
+	if err != nil || promoted != 5 {
+		t.Fatalf("promote: %v, %d promoted", err, promoted)
+	}
+
+	for stream, want := range map[string]int64{
+		PriorityQueue(queue, entity.PriorityHigh):   1,
+		PriorityQueue(queue, entity.PriorityNormal): 3,
+		PriorityQueue(queue, entity.PriorityLow):    1,
+	} {
+		n, err := r.rdb.Do(ctx, r.rdb.B().Xlen().Key(stream).Build()).AsInt64()
+		if err != nil || n != want {
+			t.Fatalf("stream %s: %v, got %d entries, want %d", stream, err, n, want)
+		}
+	}
+
+	left, err := r.rdb.Do(ctx, r.rdb.B().Zcard().Key(delayedKey(queue)).Build()).AsInt64()
+	if err != nil || left != 0 {
+		t.Fatalf("delayed queue: %v, %d left", err, left)
+	}
+}
+
+func TestPromoteDelayedItems(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	const queue = "q"
+
+	encoder, err := codec.NewEncoder("protobuf", "gzip", 0)
+	if err != nil {
+		t.Fatalf("new encoder: %v", err)
+	}
+
+	r.SetEncoder(queue, encoder)
+
+	msg := entity.Message{ID: "1", Type: 1, Payload: "payload", Priority: entity.PriorityHigh, Headers: map[string]string{"trace": "t"}}
+	if err = r.ProduceMsgAt(ctx, queue, msg, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("produce at: %v", err)
+	}
+
+	promoted, err := r.PromoteDelayed(ctx, entity.PromoteDelayedDTO{Queue: queue, Until: time.Now(), Limit: 10})
+	if err != nil || promoted != 1 {
+		t.Fatalf("promote: %v, %d promoted", err, promoted)
+	}
+
+	entries, err := r.rdb.Do(ctx, r.rdb.B().Xrange().Key(PriorityQueue(queue, entity.PriorityHigh)).Start("-").End("+").Build()).AsXRange()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("xRange: %v, %d entries", err, len(entries))
+	}
+
+	m, err := codec.Decode([]byte(entries[0].FieldValues[dataField]), parseHeaders(entries[0].FieldValues))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if m.ID != msg.ID || m.Payload != msg.Payload || m.Headers["trace"] != "t" {
+		t.Fatalf("got %+v, want %+v", m, msg)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	const queue = "q"
+
+	at := time.UnixMilli(time.Now().Add(time.Hour).UnixMilli())
+	msg := entity.Message{ID: "id", Type: 1, Payload: "first", Headers: map[string]string{"trace": "t"}}
+
+	if err := r.ProduceMsgAt(ctx, queue, msg, at); err != nil {
+		t.Fatalf("produce at: %v", err)
+	}
+
+	// scheduling the same id replaces the message and its time
+	msg.Payload = "second"
+	at = at.Add(time.Minute)
+
+	if err := r.ProduceMsgAt(ctx, queue, msg, at); err != nil {
+		t.Fatalf("produce at again: %v", err)
+	}
+
+	scheduled, found, err := r.ScheduledMsg(ctx, queue, "id")
+	if err != nil || !found {
+		t.Fatalf("scheduled message: %v, found %v", err, found)
+	}
+
+	if scheduled.Message.Payload != "second" || scheduled.Message.Headers["trace"] != "t" || !scheduled.At.Equal(at) {
+		t.Fatalf("scheduled message: %+v at %s, want payload second at %s", scheduled.Message, scheduled.At, at)
+	}
+
+	at = at.Add(time.Hour)
+
+	if ok, err := r.Reschedule(ctx, queue, "id", at); err != nil || !ok {
+		t.Fatalf("reschedule: %v, %v", err, ok)
+	}
+
+	if scheduled, _, _ = r.ScheduledMsg(ctx, queue, "id"); !scheduled.At.Equal(at) {
+		t.Fatalf("rescheduled at %s, want %s", scheduled.At, at)
+	}
+
+	// nothing is due yet
+	if promoted, err := r.PromoteDelayed(ctx, entity.PromoteDelayedDTO{Queue: queue, Until: time.Now(), Limit: 10}); err != nil || promoted != 0 {
+		t.Fatalf("promote: %v, %d promoted", err, promoted)
+	}
+
+	if ok, err := r.CancelScheduled(ctx, queue, "id"); err != nil || !ok {
+		t.Fatalf("cancel: %v, %v", err, ok)
+	}
+
+	if _, found, err = r.ScheduledMsg(ctx, queue, "id"); err != nil || found {
+		t.Fatalf("cancelled message: %v, found %v", err, found)
+	}
+
+	if ok, err := r.CancelScheduled(ctx, queue, "id"); err != nil || ok {
+		t.Fatalf("cancel again: %v, %v", err, ok)
+	}
+
+	if ok, err := r.Reschedule(ctx, queue, "id", at); err != nil || ok {
+		t.Fatalf("reschedule cancelled message: %v, %v", err, ok)
+	}
+}
+
+func TestPromoteDelayedDueInOrder(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	const queue = "q"
+
+	now := time.Now()
+
+	for i, at := range []time.Time{now.Add(-time.Second), now.Add(-time.Minute), now.Add(-time.Hour), now.Add(time.Hour)} {
+		id := strconv.Itoa(i)
+
+		msg := entity.Message{ID: id, Type: 1, Payload: "p", Headers: map[string]string{"trace": id}}
+		if err := r.ProduceMsgAt(ctx, queue, msg, at); err != nil {
+			t.Fatalf("produce at: %v", err)
+		}
+	}
+
+	promoted, err := r.PromoteDelayed(ctx, entity.PromoteDelayedDTO{Queue: queue, Until: now, Limit: 2})
+	if err != nil || promoted != 2 {
+		t.Fatalf("promote with limit: %v, %d promoted", err, promoted)
+	}
+
+	promoted, err = r.PromoteDelayed(ctx, entity.PromoteDelayedDTO{Queue: queue, Until: now, Limit: 10})
+	if err != nil || promoted != 1 {
+		t.Fatalf("promote the rest: %v, %d promoted", err, promoted)
+	}
+
+	entries, err := r.rdb.Do(ctx, r.rdb.B().Xrange().Key(queue).Start("-").End("+").Build()).AsXRange()
+	if err != nil {
+		t.Fatalf("xRange: %v", err)
+	}
+
+	// the earliest messages are promoted first, the message which is not due stays delayed
+	var order []string
+	for _, e := range entries {
+		order = append(order, parseHeaders(e.FieldValues)["trace"])
+	}
+
+	if strings.Join(order, ",") != "2,1,0" {
+		t.Fatalf("promoted in order %v, want [2 1 0]", order)
+	}
+
+	if _, found, err := r.ScheduledMsg(ctx, queue, "3"); err != nil || !found {
+		t.Fatalf("message which is not due: %v, found %v", err, found)
+	}
+}
+
+func TestPromoteDelayedMalformed(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	const queue = "q"
+
+	if err := r.ProduceMsgAt(ctx, queue, entity.Message{ID: "valid", Type: 1, Payload: "p"}, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("produce at: %v", err)
+	}
+
+	malformed := map[string]string{"cut": "1:h4:data9:x", "no length": "abc", "even": "1:h4:data"}
+
+	for id, item := range malformed {
+		if err := r.rdb.Do(ctx, r.rdb.B().Hset().Key(delayedItemsKey(queue)).FieldValue().FieldValue(id, item).Build()).Error(); err != nil {
+			t.Fatalf("hSet: %v", err)
+		}
+
+		if err := r.rdb.Do(ctx, r.rdb.B().Zadd().Key(delayedKey(queue)).ScoreMember().ScoreMember(1, id).Build()).Error(); err != nil {
+			t.Fatalf("zAdd: %v", err)
+		}
+	}
+
+	promoted, err := r.PromoteDelayed(ctx, entity.PromoteDelayedDTO{Queue: queue, Until: time.Now(), Limit: 10})
+	if err != nil || promoted != 1 {
+		t.Fatalf("promote: %v, %d promoted", err, promoted)
+	}
+
+	assertLen(t, r, queue, 1)
+
+	kept, err := r.rdb.Do(ctx, r.rdb.B().Hgetall().Key(delayedMalformedKey(queue)).Build()).AsStrMap()
+	if err != nil || len(kept) != len(malformed) {
+		t.Fatalf("malformed items: %v, %v", err, kept)
+	}
+
+	for id, item := range malformed {
+		if kept[id] != item {
+			t.Fatalf("malformed item %s: got %q, want %q", id, kept[id], item)
+		}
+	}
+
+	left, err := r.rdb.Do(ctx, r.rdb.B().Zcard().Key(delayedKey(queue)).Build()).AsInt64()
+	if err != nil || left != 0 {
+		t.Fatalf("delayed queue: %v, %d left", err, left)
+	}
+}
+
+func TestRetryAckedMessage(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	const queue, group = "q", "g"
+
+	if err := r.RegisterConsumer(ctx, queue, group, "c"); err != nil {
+		t.Fatalf("register consumer: %v", err)
+	}
+
+	if _, err := r.ProduceMsg(ctx, entity.ProduceMessageDTO{Queue: queue, Message: entity.Message{Type: 1, Payload: "p"}}); err != nil {
+		t.Fatalf("produce: %v", err)
+	}
+
+	read, err := r.Messages(ctx, entity.GetMessagesDTO{ConsumerID: "c", Queues: []string{queue}, Group: group, Limit: 1})
+	if err != nil || len(read) != 1 {
+		t.Fatalf("read messages: %v, %d messages", err, len(read))
+	}
+
+	m := read[0]
+
+	retry := func(id string) bool {
+		t.Helper()
+
+		copied := m
+		copied.ID, copied.RetryGroup = id, group
+
+		scheduled, err := r.RetryMessage(ctx, entity.RetryMessageDTO{
+			Queue: queue, Group: group, SourceQueue: queue, SourceID: m.ID, Message: copied, At: time.Now(),
+		})
+		if err != nil {
+			t.Fatalf("retry: %v", err)
+		}
+
+		return scheduled
+	}
+
+	if !retry("first") {
+		t.Fatal("retry of the pending message is not scheduled")
+	}
+
+	// the message was reclaimed by another consumer which failed it too
+	if retry("second") {
+		t.Fatal("retry of the acked message is scheduled")
+	}
+
+	if _, found, _ := r.ScheduledMsg(ctx, queue, "second"); found {
+		t.Fatal("the second retry is scheduled")
+	}
+}
@@ -0,0 +1,145 @@
+package redis
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/veleton777/redis_queue/internal/codec"
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+// headerPrefix marks the stream fields holding the headers of the message, so they can't clash with data.
+const headerPrefix = "h:"
+
+// SetEncoder sets the codec of the messages produced to the queue, it must be called before the repo is used.
+// Messages of queues without an encoder are json.
+func (r *Repo) SetEncoder(queue string, enc codec.Encoder) {
+	r.encoders[queue] = enc
+}
+
+// encode returns the data of the message encoded by the encoder of the queue
+// and the field-value pairs of its headers.
+func (r *Repo) encode(queue string, m entity.Message) (string, []string, error) {
+	data, headers, err := r.encoders[queue].Encode(m)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "encode message")
+	}
+
+	return string(data), headerFields(headers), nil
+}
+
+// headerFields returns the field-value pairs of the headers sorted by name.
+func headerFields(headers map[string]string) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	fields := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		fields = append(fields, headerPrefix+name, headers[name])
+	}
+
+	return fields
+}
+
+// parseHeaders returns the headers from the fields of the stream entry, nil for entries with only data.
+func parseHeaders(fields map[string]string) map[string]string {
+	var headers map[string]string
+
+	for field, v := range fields {
+		name, ok := strings.CutPrefix(field, headerPrefix)
+		if !ok {
+			continue
+		}
+
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+
+		headers[name] = v
+	}
+
+	return headers
+}
+
+// encodeItem returns the data of the delayed message saved in the delayed items hash:
+// the list of its priority and the fields of its future stream entry, every string is prefixed
+// by its length and ':'. The list keeps binary data of the codecs as is and is split by the promote script.
+func (r *Repo) encodeItem(queue string, m entity.Message) (string, error) {
+	data, headers, err := r.encode(queue, m)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+
+	for _, s := range append([]string{string(m.Priority), dataField, data}, headers...) {
+		b.WriteString(strconv.Itoa(len(s)))
+		b.WriteByte(':')
+		b.WriteString(s)
+	}
+
+	return b.String(), nil
+}
+
+// splitItem returns the strings of the item saved by encodeItem.
+func splitItem(item string) ([]string, error) {
+	var parts []string
+
+	for item != "" {
+		size, rest, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, errors.New("no length of the delayed item part")
+		}
+
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 || n > len(rest) {
+			return nil, errors.Errorf("bad length of the delayed item part: %q", size)
+		}
+
+		parts = append(parts, rest[:n])
+		item = rest[n:]
+	}
+
+	if len(parts) < 3 || len(parts)%2 == 0 {
+		return nil, errors.Errorf("delayed item has %d parts", len(parts))
+	}
+
+	return parts, nil
+}
+
+// decodeItem parses the data of the delayed message, items saved before headers were added
+// hold the message json.
+func decodeItem(item string) (entity.Message, error) {
+	if strings.HasPrefix(item, "{") {
+		var m entity.Message
+		if err := json.Unmarshal([]byte(item), &m); err != nil {
+			return entity.Message{}, errors.Wrap(err, "json unmarshal")
+		}
+
+		return m, nil
+	}
+
+	parts, err := splitItem(item)
+	if err != nil {
+		return entity.Message{}, err
+	}
+
+	fields := make(map[string]string, len(parts)/2)
+	for i := 1; i+1 < len(parts); i += 2 {
+		fields[parts[i]] = parts[i+1]
+	}
+
+	m, err := codec.Decode([]byte(fields[dataField]), parseHeaders(fields))
+	if err != nil {
+		return entity.Message{}, errors.Wrap(err, "decode message")
+	}
+
+	return m, nil
+}
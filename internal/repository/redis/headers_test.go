@@ -0,0 +1,63 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/veleton777/redis_queue/internal/codec"
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+func TestDecodeItem(t *testing.T) {
+	r := NewRepo(nil)
+
+	encoder, err := codec.NewEncoder("protobuf", "zstd", 0)
+	if err != nil {
+		t.Fatalf("new encoder: %v", err)
+	}
+
+	r.SetEncoder("q", encoder)
+
+	msg := entity.Message{
+		ID:       "1",
+		Type:     2,
+		Payload:  "payload",
+		Priority: entity.PriorityHigh,
+		Headers:  map[string]string{"trace": "t"},
+	}
+
+	item, err := r.encodeItem("q", msg)
+	if err != nil {
+		t.Fatalf("encode item: %v", err)
+	}
+
+	items := map[string]string{
+		"item": item,
+		// items saved before headers were added
+		"legacy json": `{"id":"1","type":2,"payload":"payload","priority":"high"}`,
+	}
+
+	for name, item := range items {
+		t.Run(name, func(t *testing.T) {
+			m, err := decodeItem(item)
+			if err != nil {
+				t.Fatalf("decode item: %v", err)
+			}
+
+			if m.ID != msg.ID || m.Type != msg.Type || m.Payload != msg.Payload || m.Priority != msg.Priority {
+				t.Fatalf("got %+v, want %+v", m, msg)
+			}
+
+			if name != "legacy json" && m.Headers["trace"] != "t" {
+				t.Fatalf("got %+v, want %+v", m, msg)
+			}
+		})
+	}
+}
+
+func TestDecodeItemMalformed(t *testing.T) {
+	for _, item := range []string{"", "{", "[", "abc", "1:h", "1:h4:data", "x:h4:data1:p", "-1:h4:data1:p"} {
+		if _, err := decodeItem(item); err == nil {
+			t.Fatalf("decode item %q: expected error", item)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/rueidis"
+)
+
+// releaseLockScript deletes the lock only if it is still held with the token.
+var releaseLockScript = rueidis.NewLuaScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+
+return 0
+`)
+
+// refreshLockScript extends the lock only if it is still held with the token.
+var refreshLockScript = rueidis.NewLuaScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+
+return 0
+`)
+
+// SetLock sets the lock key to the token if the key does not exist and reports whether it was set.
+func (r *Repo) SetLock(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	err := r.rdb.Do(ctx, r.rdb.B().Set().Key(key).Value(token).Nx().Px(ttl).Build()).Error()
+	if rueidis.IsRedisNil(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, errors.Wrap(err, "redis set nx")
+	}
+
+	return true, nil
+}
+
+// ReleaseLock deletes the lock key if it holds the token and reports whether it was deleted.
+func (r *Repo) ReleaseLock(ctx context.Context, key, token string) (bool, error) {
+	released, err := releaseLockScript.Exec(ctx, r.rdb, []string{key}, []string{token}).AsInt64()
+	if err != nil {
+		return false, errors.Wrap(err, "redis release lock script")
+	}
+
+	return released == 1, nil
+}
+
+// RefreshLock sets the new ttl of the lock key if it holds the token and reports whether it was set.
+func (r *Repo) RefreshLock(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	refreshed, err := refreshLockScript.Exec(
+		ctx, r.rdb, []string{key}, []string{token, strconv.FormatInt(ttl.Milliseconds(), 10)},
+	).AsInt64()
+	if err != nil {
+		return false, errors.Wrap(err, "redis refresh lock script")
+	}
+
+	return refreshed == 1, nil
+}
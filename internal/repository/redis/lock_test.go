@@ -0,0 +1,48 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	const key = "lock"
+
+	if ok, err := r.SetLock(ctx, key, "a", time.Second); err != nil || !ok {
+		t.Fatalf("set lock: %v, %v", err, ok)
+	}
+
+	if ok, err := r.SetLock(ctx, key, "b", time.Second); err != nil || ok {
+		t.Fatalf("set held lock: %v, %v", err, ok)
+	}
+
+	// another owner can neither extend nor release the lock
+	if ok, err := r.RefreshLock(ctx, key, "b", time.Minute); err != nil || ok {
+		t.Fatalf("refresh lock of another owner: %v, %v", err, ok)
+	}
+
+	if ok, err := r.ReleaseLock(ctx, key, "b"); err != nil || ok {
+		t.Fatalf("release lock of another owner: %v, %v", err, ok)
+	}
+
+	if ok, err := r.RefreshLock(ctx, key, "a", time.Minute); err != nil || !ok {
+		t.Fatalf("refresh lock: %v, %v", err, ok)
+	}
+
+	ttl, err := r.rdb.Do(ctx, r.rdb.B().Pttl().Key(key).Build()).AsInt64()
+	if err != nil || ttl <= time.Second.Milliseconds() {
+		t.Fatalf("ttl of refreshed lock: %v, %dms", err, ttl)
+	}
+
+	if ok, err := r.ReleaseLock(ctx, key, "a"); err != nil || !ok {
+		t.Fatalf("release lock: %v, %v", err, ok)
+	}
+
+	if ok, err := r.SetLock(ctx, key, "b", time.Second); err != nil || !ok {
+		t.Fatalf("set released lock: %v, %v", err, ok)
+	}
+}
@@ -0,0 +1,149 @@
+package redis
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+func TestProduceDedup(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	dto := entity.ProduceMessageDTO{
+		Queue:       "q",
+		Message:     entity.Message{Payload: "p", IdempotencyKey: "key"},
+		DedupWindow: time.Minute,
+	}
+
+	first, err := r.ProduceMsg(ctx, dto)
+	if err != nil {
+		t.Fatalf("produce: %v", err)
+	}
+
+	second, err := r.ProduceMsg(ctx, dto)
+	if err != nil || second != first {
+		t.Fatalf("produce the same key: %v, got id %s, want %s", err, second, first)
+	}
+
+	dto.Message.IdempotencyKey = "other"
+
+	third, err := r.ProduceMsg(ctx, dto)
+	if err != nil || third == first {
+		t.Fatalf("produce another key: %v, got id %s", err, third)
+	}
+
+	assertLen(t, r, "q", 2)
+
+	// the dedup key is shared by all priorities of the queue
+	dto.Message.Priority = entity.PriorityHigh
+
+	if id, err := r.ProduceMsg(ctx, dto); err != nil || id != third {
+		t.Fatalf("produce the key with another priority: %v, got id %s, want %s", err, id, third)
+	}
+}
+
+func TestProduceDedupWindowUnderMilli(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	dto := entity.ProduceMessageDTO{
+		Queue:       "q",
+		Message:     entity.Message{Payload: "p", IdempotencyKey: "key"},
+		DedupWindow: 500 * time.Microsecond,
+	}
+
+	if _, err := r.ProduceMsg(ctx, dto); err != nil {
+		t.Fatalf("produce with a window under 1ms: %v", err)
+	}
+
+	ttl, err := r.rdb.Do(ctx, r.rdb.B().Pttl().Key(dedupKey("q", "key")).Build()).AsInt64()
+	if err != nil {
+		t.Fatalf("pTTL: %v", err)
+	}
+
+	if ttl == -1 {
+		t.Fatal("dedup key has no ttl")
+	}
+
+	assertLen(t, r, "q", 1)
+}
+
+func TestProduceBatchDedup(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	results := r.ProduceBatch(ctx, entity.ProduceBatchDTO{
+		Queue: "q",
+		Messages: []entity.Message{
+			{Payload: "1", IdempotencyKey: "a"},
+			{Payload: "2", IdempotencyKey: "a"},
+			{Payload: "3"},
+		},
+		DedupWindow: time.Minute,
+	})
+
+	for i, res := range results {
+		if res.Err != nil {
+			t.Fatalf("message %d: %v", i, res.Err)
+		}
+	}
+
+	if results[0].ID != results[1].ID {
+		t.Fatalf("messages with the same key got ids %s and %s", results[0].ID, results[1].ID)
+	}
+
+	assertLen(t, r, "q", 2)
+}
+
+func assertLen(t *testing.T, r *Repo, stream string, want int64) {
+	t.Helper()
+
+	n, err := r.rdb.Do(context.Background(), r.rdb.B().Xlen().Key(stream).Build()).AsInt64()
+	if err != nil {
+		t.Fatalf("xLen %s: %v", stream, err)
+	}
+
+	if n != want {
+		t.Fatalf("stream %s has %d entries, want %d", stream, n, want)
+	}
+}
+
+func TestProduceCapReject(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	dto := entity.ProduceMessageDTO{
+		Queue:   "q",
+		Message: entity.Message{Payload: "p"},
+		Cap:     entity.StreamCap{Mode: entity.CapReject, MaxLen: 2},
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.ProduceMsg(ctx, dto); err != nil {
+			t.Fatalf("produce %d: %v", i, err)
+		}
+	}
+
+	if _, err := r.ProduceMsg(ctx, dto); !errors.Is(err, entity.ErrQueueFull) {
+		t.Fatalf("produce to the full stream: got %v, want ErrQueueFull", err)
+	}
+
+	assertLen(t, r, "q", 2)
+}
+
+func TestProduceErr(t *testing.T) {
+	for _, err := range []error{context.Canceled, context.DeadlineExceeded, errors.Wrap(context.Canceled, "do")} {
+		if got := produceErr(err); errors.Is(got, entity.ErrUnavailable) || !errors.Is(got, err) {
+			t.Fatalf("produce error %v: got %v, want the context error", err, got)
+		}
+	}
+
+	if got := produceErr(io.EOF); !errors.Is(got, entity.ErrUnavailable) {
+		t.Fatalf("produce error %v: got %v, want ErrUnavailable", io.EOF, got)
+	}
+}
@@ -2,58 +2,192 @@ package redis
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/redis/rueidis"
+	"github.com/veleton777/redis_queue/internal/codec"
 	"github.com/veleton777/redis_queue/internal/entity"
 )
 
 var errRegisGroupAlreadyExists = errors.New("BUSYGROUP Consumer Group name already exists")
 
-const dataField = "data"
+const (
+	dataField = "data"
+
+	sourceIDField   = "source_id"
+	errorField      = "error"
+	consumerIDField = "consumer_id"
+	deliveriesField = "deliveries"
+	producedAtField = "produced_at"
+	failedAtField   = "failed_at"
+)
+
+// deadLetterScript copies the message into the dead-letter stream with the last saved error
+// (or the given reason if there is none) and acks it in the source queue in one step.
+// The source id of a retry is the id of the message it was made from. The payload offloaded
+// by claim-check in KEYS[4] is copied inline and released if the message was not acked before.
+// The headers of the message follow the other arguments.
+var deadLetterScript = rueidis.NewLuaScript(releasePayloadLua + `
+local err = redis.call('HGET', KEYS[3], ARGV[2])
+if not err then
+	err = ARGV[8]
+end
+
+local fields = {
+	'` + dataField + `', ARGV[3],
+	'` + sourceIDField + `', ARGV[9],
+	'` + errorField + `', err,
+	'` + consumerIDField + `', ARGV[4],
+	'` + producedAtField + `', ARGV[5],
+	'` + failedAtField + `', ARGV[6],
+	'` + deliveriesField + `', ARGV[7],
+}
+for i = 11, #ARGV do
+	fields[#fields + 1] = ARGV[i]
+end
+
+redis.call('XADD', KEYS[2], '*', unpack(fields))
+if redis.call('XACK', KEYS[1], ARGV[1], ARGV[2]) == 1 then
+	releasePayload(KEYS[1], KEYS[4], ARGV[9], ARGV[10] == '1')
+end
+redis.call('HDEL', KEYS[3], ARGV[2])
+
+return 1
+`)
+
+// removeIdleConsumerScript checks the consumer and removes it in one step,
+// so a consumer that took messages after the check can't lose them.
+var removeIdleConsumerScript = rueidis.NewLuaScript(`
+local consumers = redis.call('XINFO', 'CONSUMERS', KEYS[1], ARGV[1])
+
+for _, c in ipairs(consumers) do
+	local info = {}
+	for i = 1, #c, 2 do
+		info[c[i]] = c[i + 1]
+	end
+
+	if info['name'] == ARGV[2] then
+		if info['pending'] > 0 or info['idle'] < tonumber(ARGV[3]) then
+			return 0
+		end
+
+		redis.call('XGROUP', 'DELCONSUMER', KEYS[1], ARGV[1], ARGV[2])
+
+		return 1
+	end
+end
+
+return 0
+`)
+
+// produceScript adds the message unless the dedup key KEYS[2] holds the id of the same message,
+// the key is set to the id of the added message for the dedup window. The stream is capped
+// by ARGV[3] mode with ARGV[4] threshold: maxlen and minid trim it by the XADD itself,
+// reject returns an error if the stream is full. A payload offloaded by claim-check is saved
+// in KEYS[3] with ARGV[6] ttl.
+// The fields of the entry are the data in ARGV[1] and the header pairs from ARGV[7].
+// Unused keys are empty.
+var produceScript = rueidis.NewLuaScript(`
+if KEYS[2] ~= '' then
+	local id = redis.call('GET', KEYS[2])
+	if id then
+		return id
+	end
+end
+
+if ARGV[3] == '` + string(entity.CapReject) + `' and redis.call('XLEN', KEYS[1]) >= tonumber(ARGV[4]) then
+	return redis.error_reply('` + errQueueFull + `')
+end
+
+if KEYS[3] ~= '' then
+	redis.call('HSET', KEYS[3], '` + blobDataField + `', ARGV[5])
+	redis.call('PEXPIRE', KEYS[3], ARGV[6])
+end
+
+local fields = {'` + dataField + `', ARGV[1]}
+for i = 7, #ARGV do
+	fields[#fields + 1] = ARGV[i]
+end
+
+local id
+if ARGV[3] == '` + string(entity.CapMaxLen) + `' then
+	id = redis.call('XADD', KEYS[1], 'MAXLEN', '~', ARGV[4], '*', unpack(fields))
+elseif ARGV[3] == '` + string(entity.CapMinID) + `' then
+	id = redis.call('XADD', KEYS[1], 'MINID', '~', ARGV[4], '*', unpack(fields))
+else
+	id = redis.call('XADD', KEYS[1], '*', unpack(fields))
+end
+
+if KEYS[2] ~= '' then
+	redis.call('SET', KEYS[2], id, 'PX', ARGV[2])
+end
+
+return id
+`)
+
+// errQueueFull is the error reply of produceScript for a full stream.
+const errQueueFull = "QUEUEFULL stream reached its max length"
 
 type Repo struct {
 	rdb rueidis.Client
+	// encoders are the codecs of the queues by their names
+	encoders map[string]codec.Encoder
 }
 
 func NewRepo(redisClient rueidis.Client) *Repo {
 	return &Repo{
-		rdb: redisClient,
+		rdb:      redisClient,
+		encoders: make(map[string]codec.Encoder),
 	}
 }
 
 func (r *Repo) Messages(ctx context.Context, dto entity.GetMessagesDTO) ([]entity.Message, error) {
-	resp := r.rdb.Do(
-		ctx,
-		r.rdb.B().Xreadgroup().Group(dto.Group, dto.ConsumerID).Count(int64(dto.Limit)).Block(dto.BlockTime.Milliseconds()).Streams().Key(dto.Queue).Id(">").Build(),
-	)
+	cmd := r.rdb.B().Xreadgroup().Group(dto.Group, dto.ConsumerID).Count(int64(dto.Limit))
+
+	var resp rueidis.RedisResult
+	if dto.BlockTime > 0 {
+		resp = r.rdb.Do(ctx, cmd.Block(dto.BlockTime.Milliseconds()).Streams().Key(dto.Queues...).Id(repeatID(">", len(dto.Queues))...).Build())
+	} else {
+		resp = r.rdb.Do(ctx, cmd.Streams().Key(dto.Queues...).Id(repeatID(">", len(dto.Queues))...).Build())
+	}
 
 	tasks, err := resp.AsXRead()
 	if err != nil && resp.NonRedisError() != nil {
 		return nil, errors.Wrap(err, "get tasks")
 	}
 
-	messages := make([]entity.Message, 0, len(tasks))
-
-	for _, t := range tasks[dto.Queue] {
-		data, ok := t.FieldValues[dataField]
-		if !ok {
-			return nil, fmt.Errorf("not found data in task: %v", t.ID)
-		}
+	var (
+		messages  []entity.Message
+		malformed []malformedEntry
+	)
 
-		var m entity.Message
-		err := json.Unmarshal([]byte(data), &m)
-		if err != nil {
-			return nil, errors.Wrap(err, "json unmarshal")
+	for _, queue := range dto.Queues {
+		for _, t := range tasks[queue] {
+			m, err := parseMessage(t)
+			if err != nil {
+				malformed = append(malformed, malformedEntry{
+					entry:   t,
+					message: entity.Message{ID: t.ID, Queue: queue, Deliveries: 1},
+					err:     err,
+				})
+				continue
+			}
+
+			m.Queue = queue
+			m.Deliveries = 1
+
+			messages = append(messages, m)
 		}
+	}
 
-		m.ID = t.ID
-
-		messages = append(messages, m)
+	err = r.deadLetterMalformed(ctx, dto.DeadLetterQueue, dto.Group, dto.ConsumerID, malformed)
+	if err != nil {
+		return nil, errors.Wrap(err, "dead letter malformed messages")
 	}
 
 	return messages, nil
@@ -73,76 +207,327 @@ func (r *Repo) FailedMessages(ctx context.Context, dto entity.GetFailedMessagesD
 	}
 
 	tasks, err := resp[1].AsXRange()
+	if err != nil {
+		return nil, errors.Wrap(err, "parse failed tasks")
+	}
 
-	messages := make([]entity.Message, 0, len(tasks))
+	var (
+		messages  = make([]entity.Message, 0, len(tasks))
+		malformed []malformedEntry
+		bad       []entity.Message
+	)
 
 	for _, t := range tasks {
-		data, ok := t.FieldValues[dataField]
-		if !ok {
-			return nil, fmt.Errorf("not found data in task: %v", t.ID)
-		}
-
-		var m entity.Message
-		err = json.Unmarshal([]byte(data), &m)
+		m, err := parseMessage(t)
 		if err != nil {
-			return nil, errors.Wrap(err, "json unmarshal")
+			malformed = append(malformed, malformedEntry{entry: t, err: err})
+			bad = append(bad, entity.Message{ID: t.ID, Queue: dto.Queue})
+			continue
 		}
 
-		m.ID = t.ID
+		m.Queue = dto.Queue
 
 		messages = append(messages, m)
 	}
 
+	if err = r.fillDeliveries(ctx, dto.Queue, dto.Group, messages); err != nil {
+		return nil, errors.Wrap(err, "fill deliveries")
+	}
+
+	if err = r.fillDeliveries(ctx, dto.Queue, dto.Group, bad); err != nil {
+		return nil, errors.Wrap(err, "fill deliveries of malformed messages")
+	}
+
+	for i := range malformed {
+		malformed[i].message = bad[i]
+	}
+
+	queue := dto.DeadLetterQueue
+	if queue == "" {
+		queue = dto.Queue
+	}
+
+	if err = r.deadLetterMalformed(ctx, queue, dto.Group, dto.ConsumerID, malformed); err != nil {
+		return nil, errors.Wrap(err, "dead letter malformed messages")
+	}
+
 	return messages, nil
 }
 
-func (r *Repo) AckMessages(ctx context.Context, queue string, ids []string) error {
+// malformedEntry is a stream entry which can't be decoded into a message.
+type malformedEntry struct {
+	entry rueidis.XRangeEntry
+	// message holds the id, the stream and the delivery counter of the entry
+	message entity.Message
+	err     error
+}
+
+// deadLetterMalformed moves the entries which can't be decoded to the dead-letter queue of the group
+// with their data and headers as they are. They would fail on every delivery, so they are not retried.
+// The stream of the entry is used as the queue if queue is empty.
+func (r *Repo) deadLetterMalformed(ctx context.Context, queue, group, consumerID string, entries []malformedEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	execs := make([]rueidis.LuaExec, 0, len(entries))
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	for _, e := range entries {
+		m := e.message
+
+		dlq := queue
+		if dlq == "" {
+			dlq = m.Queue
+		}
+
+		var headers []string
+		for field, v := range e.entry.FieldValues {
+			if strings.HasPrefix(field, headerPrefix) {
+				headers = append(headers, field, v)
+			}
+		}
+
+		execs = append(execs, rueidis.LuaExec{
+			Keys: []string{m.Queue, deadLetterKey(dlq, group), errorsKey(m.Queue, group), ""},
+			Args: append([]string{
+				group,
+				m.ID,
+				e.entry.FieldValues[dataField],
+				consumerID,
+				strconv.FormatInt(producedAt(m.ID).UnixMilli(), 10),
+				now,
+				strconv.FormatInt(m.Deliveries, 10),
+				"malformed message: " + e.err.Error(),
+				m.ID,
+				"0",
+			}, headers...),
+		})
+	}
+
+	for _, resp := range deadLetterScript.ExecMulti(ctx, r.rdb, execs...) {
+		if err := resp.Error(); err != nil {
+			return errors.Wrap(err, "redis dead letter script")
+		}
+	}
+
+	return nil
+}
+
+// fillDeliveries sets the delivery counters of claimed messages from the pending entries list of the group.
+func (r *Repo) fillDeliveries(ctx context.Context, queue, group string, messages []entity.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	cmds := make(rueidis.Commands, 0, len(messages))
+	for _, m := range messages {
+		cmds = append(cmds, r.rdb.B().Xpending().Key(queue).Group(group).Start(m.ID).End(m.ID).Count(1).Build())
+	}
+
+	for i, resp := range r.rdb.DoMulti(ctx, cmds...) {
+		entries, err := resp.ToArray()
+		if err != nil {
+			return errors.Wrap(err, "redis xPending")
+		}
+
+		if len(entries) == 0 {
+			continue
+		}
+
+		entry, err := entries[0].ToArray()
+		if err != nil || len(entry) != 4 {
+			return fmt.Errorf("unexpected pending entry for message: %v", messages[i].ID)
+		}
+
+		messages[i].Deliveries, err = entry[3].AsInt64()
+		if err != nil {
+			return errors.Wrap(err, "parse deliveries")
+		}
+	}
+
+	return nil
+}
+
+func (r *Repo) AckMessages(ctx context.Context, queue, group string, ids []string) error {
+	for _, resp := range r.rdb.DoMulti(
+		ctx,
+		r.rdb.B().Xack().Key(queue).Group(group).Id(ids...).Build(),
+		r.rdb.B().Hdel().Key(errorsKey(queue, group)).Field(ids...).Build(),
+	) {
+		if err := resp.Error(); err != nil {
+			return errors.Wrap(err, "ack messages")
+		}
+	}
+
+	return nil
+}
+
+// SaveMessageError keeps the last handler error of a pending message until the message is acked.
+func (r *Repo) SaveMessageError(ctx context.Context, dto entity.SaveMessageErrorDTO) error {
 	err := r.rdb.Do(
 		ctx,
-		r.rdb.B().Xdel().Key(queue).Id(ids...).Build(),
+		r.rdb.B().Hset().Key(errorsKey(dto.Queue, dto.Group)).FieldValue().FieldValue(dto.ID, dto.Err).Build(),
 	).Error()
 	if err != nil {
-		return errors.Wrap(err, "ack messages")
+		return errors.Wrap(err, "redis hSet")
 	}
 
 	return nil
 }
 
-func (r *Repo) ProduceMsg(ctx context.Context, queue string, msg entity.Message) error {
-	b, err := json.Marshal(msg)
+// DeadLetterMessage copies the message into the dead-letter queue of the group and acks it in the stream
+// it was read from, the dead-letter queue is shared by all priorities of the queue.
+func (r *Repo) DeadLetterMessage(ctx context.Context, dto entity.DeadLetterMessageDTO) error {
+	// the loaded payload of a claim-check is kept inline, the blob is released by the script
+	m := dto.Message
+	if m.Payload != "" {
+		m.ClaimCheck = ""
+	}
+
+	data, headers, err := r.encode(dto.Queue, m)
 	if err != nil {
-		return errors.Wrap(err, "json marshal")
+		return err
 	}
 
-	err = r.rdb.Do(
+	source := dto.Message.Queue
+	if source == "" {
+		source = dto.Queue
+	}
+
+	err = deadLetterScript.Exec(
 		ctx,
-		r.rdb.B().Xadd().Key(queue).
-			Id("*").FieldValue().FieldValue(dataField, string(b)).Build(),
+		r.rdb,
+		[]string{source, deadLetterKey(dto.Queue, dto.Group), errorsKey(source, dto.Group), dto.Message.ClaimCheck},
+		append([]string{
+			dto.Group,
+			dto.Message.ID,
+			data,
+			dto.ConsumerID,
+			strconv.FormatInt(producedAt(dto.Message.SourceID()).UnixMilli(), 10),
+			strconv.FormatInt(time.Now().UnixMilli(), 10),
+			strconv.FormatInt(dto.Message.Deliveries, 10),
+			dto.Reason,
+			dto.Message.SourceID(),
+			retryFlag(dto.Message),
+		}, headers...),
 	).Error()
 	if err != nil {
-		return fmt.Errorf("redis xAdd: %w", err)
+		return errors.Wrap(err, "redis dead letter script")
 	}
 
 	return nil
 }
 
+func (r *Repo) DeadLetterMessages(ctx context.Context, dto entity.GetDeadLetterMessagesDTO) ([]entity.Message, error) {
+	start := dto.Start
+	if start == "" {
+		start = "-"
+	}
+
+	tasks, err := r.rdb.Do(
+		ctx,
+		r.rdb.B().Xrange().Key(deadLetterKey(dto.Queue, dto.Group)).Start(start).End("+").Count(int64(dto.Limit)).Build(),
+	).AsXRange()
+	if err != nil {
+		return nil, errors.Wrap(err, "redis xRange")
+	}
+
+	messages := make([]entity.Message, 0, len(tasks))
+
+	for _, t := range tasks {
+		// a malformed message is listed with its data as the payload
+		m, err := parseMessage(t)
+		if err != nil {
+			m = entity.Message{ID: t.ID, Payload: t.FieldValues[dataField], Headers: parseHeaders(t.FieldValues)}
+		}
+
+		m.DeadLetter = parseDeadLetter(t.FieldValues)
+		m.Deliveries = m.DeadLetter.Deliveries
+
+		messages = append(messages, m)
+	}
+
+	return messages, nil
+}
+
+// ProduceMsg adds the message to the stream of its priority and returns its stream id.
+// A message with the idempotency key already produced within the dedup window is not added again,
+// the id of the first message is returned instead.
+func (r *Repo) ProduceMsg(ctx context.Context, dto entity.ProduceMessageDTO) (string, error) {
+	exec, err := r.produceExec(dto.Queue, dto.Message, dto.DedupWindow, dto.Cap, dto.ClaimCheck)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := produceScript.Exec(ctx, r.rdb, exec.Keys, exec.Args).ToString()
+	if err != nil {
+		return "", produceErr(err)
+	}
+
+	return id, nil
+}
+
+// ProduceBatch adds the messages like ProduceMsg in one pipeline and returns the result of every message
+// in the order of the messages, a failed message does not stop the others.
+func (r *Repo) ProduceBatch(ctx context.Context, dto entity.ProduceBatchDTO) []entity.ProduceResult {
+	results := make([]entity.ProduceResult, len(dto.Messages))
+
+	execs := make([]rueidis.LuaExec, 0, len(dto.Messages))
+	idx := make([]int, 0, len(dto.Messages))
+
+	for i, m := range dto.Messages {
+		exec, err := r.produceExec(dto.Queue, m, dto.DedupWindow, dto.Cap, dto.ClaimCheck)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		execs = append(execs, exec)
+		idx = append(idx, i)
+	}
+
+	if len(execs) == 0 {
+		return results
+	}
+
+	for i, resp := range produceScript.ExecMulti(ctx, r.rdb, execs...) {
+		id, err := resp.ToString()
+		if err != nil {
+			results[idx[i]].Err = produceErr(err)
+			continue
+		}
+
+		results[idx[i]].ID = id
+	}
+
+	return results
+}
+
+// RegisterConsumer creates the group if the queue has no such group yet and adds the consumer to it,
+// other groups of the queue are left untouched.
 func (r *Repo) RegisterConsumer(ctx context.Context, queue, group, consumerID string) error {
 	stream, err := r.rdb.Do(
 		ctx,
 		r.rdb.B().Exists().Key(queue).Build(),
 	).AsInt64()
+	if err != nil {
+		return errors.Wrap(err, "redis exists")
+	}
 
 	var isExistGroup bool
 	if stream != 0 {
-		groupInfo, err := r.rdb.Do(
-			ctx,
-			r.rdb.B().XinfoGroups().Key(queue).Build(),
-		).ToMessage()
+		groups, err := r.Groups(ctx, queue)
 		if err != nil {
-			return errors.Wrap(err, "redis XinfoGroups")
+			return errors.Wrap(err, "get groups")
 		}
 
-		isExistGroup = strings.Contains(groupInfo.String(), group)
+		for _, g := range groups {
+			if g.Name == group {
+				isExistGroup = true
+				break
+			}
+		}
 	}
 
 	if !isExistGroup {
@@ -167,3 +552,376 @@ func (r *Repo) RegisterConsumer(ctx context.Context, queue, group, consumerID st
 
 	return nil
 }
+
+func (r *Repo) Consumers(ctx context.Context, queue, group string) ([]entity.ConsumerInfo, error) {
+	resp, err := r.rdb.Do(
+		ctx,
+		r.rdb.B().XinfoConsumers().Key(queue).Group(group).Build(),
+	).ToArray()
+	if err != nil {
+		return nil, errors.Wrap(err, "redis xInfoConsumers")
+	}
+
+	consumers := make([]entity.ConsumerInfo, 0, len(resp))
+
+	for _, c := range resp {
+		fields, err := c.AsMap()
+		if err != nil {
+			return nil, errors.Wrap(err, "parse consumer info")
+		}
+
+		consumers = append(consumers, entity.ConsumerInfo{
+			Name:    mapString(fields, "name"),
+			Pending: mapInt64(fields, "pending"),
+			Idle:    time.Duration(mapInt64(fields, "idle")) * time.Millisecond,
+		})
+	}
+
+	return consumers, nil
+}
+
+// ClaimPending moves up to dto.Limit pending messages from one consumer to another, the delivery counters
+// and the idle times of the messages are kept, so they are reclaimed as if they were not moved.
+func (r *Repo) ClaimPending(ctx context.Context, dto entity.ClaimPendingDTO) (entity.ClaimPendingResult, error) {
+	start := "-"
+	if dto.After != "" {
+		start = nextID(dto.After)
+	}
+
+	entries, err := r.rdb.Do(
+		ctx,
+		r.rdb.B().Xpending().Key(dto.Queue).Group(dto.Group).Start(start).End("+").Count(int64(dto.Limit)).Consumer(dto.From).Build(),
+	).ToArray()
+	if err != nil {
+		return entity.ClaimPendingResult{}, errors.Wrap(err, "redis xPending")
+	}
+
+	cmds := make(rueidis.Commands, 0, len(entries))
+
+	var res entity.ClaimPendingResult
+
+	for _, e := range entries {
+		entry, err := e.ToArray()
+		if err != nil || len(entry) < 3 {
+			return entity.ClaimPendingResult{}, fmt.Errorf("unexpected pending entry of consumer: %v", dto.From)
+		}
+
+		id, err := entry[0].ToString()
+		if err != nil {
+			return entity.ClaimPendingResult{}, errors.Wrap(err, "parse pending entry id")
+		}
+
+		idle, err := entry[2].AsInt64()
+		if err != nil {
+			return entity.ClaimPendingResult{}, errors.Wrap(err, "parse pending entry idle time")
+		}
+
+		cmds = append(cmds, r.rdb.B().Xclaim().Key(dto.Queue).Group(dto.Group).Consumer(dto.To).MinIdleTime("0").
+			Id(id).Idle(idle).Justid().Build())
+		res.Last = id
+	}
+
+	if len(cmds) == 0 {
+		return res, nil
+	}
+
+	for _, resp := range r.rdb.DoMulti(ctx, cmds...) {
+		claimed, err := resp.AsStrSlice()
+		if err != nil {
+			return entity.ClaimPendingResult{}, errors.Wrap(err, "redis xClaim")
+		}
+
+		res.Claimed += len(claimed)
+	}
+
+	return res, nil
+}
+
+func (r *Repo) RemoveConsumer(ctx context.Context, queue, group, consumerID string) error {
+	err := r.rdb.Do(
+		ctx,
+		r.rdb.B().XgroupDelconsumer().Key(queue).Group(group).Consumername(consumerID).Build(),
+	).Error()
+	if err != nil {
+		return errors.Wrap(err, "redis xGroupDelConsumer")
+	}
+
+	return nil
+}
+
+// RemoveIdleConsumer removes the consumer from the group only if it has been idle for dto.MinIdle
+// and has no pending messages, so it is safe to call for a consumer that may come back to life.
+func (r *Repo) RemoveIdleConsumer(ctx context.Context, dto entity.RemoveIdleConsumerDTO) (bool, error) {
+	removed, err := removeIdleConsumerScript.Exec(
+		ctx,
+		r.rdb,
+		[]string{dto.Queue},
+		[]string{dto.Group, dto.ConsumerID, strconv.FormatInt(dto.MinIdle.Milliseconds(), 10)},
+	).AsInt64()
+	if err != nil {
+		return false, errors.Wrap(err, "redis remove idle consumer script")
+	}
+
+	return removed == 1, nil
+}
+
+func (r *Repo) Groups(ctx context.Context, queue string) ([]entity.GroupInfo, error) {
+	resp, err := r.rdb.Do(
+		ctx,
+		r.rdb.B().XinfoGroups().Key(queue).Build(),
+	).ToArray()
+	if err != nil {
+		return nil, errors.Wrap(err, "redis xInfoGroups")
+	}
+
+	groups := make([]entity.GroupInfo, 0, len(resp))
+
+	for _, g := range resp {
+		fields, err := g.AsMap()
+		if err != nil {
+			return nil, errors.Wrap(err, "parse group info")
+		}
+
+		groups = append(groups, entity.GroupInfo{
+			Name:            mapString(fields, "name"),
+			Pending:         mapInt64(fields, "pending"),
+			LastDeliveredID: mapString(fields, "last-delivered-id"),
+		})
+	}
+
+	return groups, nil
+}
+
+// OldestPendingID returns the smallest id of the pending entries of the group, it is empty if nothing is pending.
+func (r *Repo) OldestPendingID(ctx context.Context, queue, group string) (string, error) {
+	resp, err := r.rdb.Do(
+		ctx,
+		r.rdb.B().Xpending().Key(queue).Group(group).Build(),
+	).ToArray()
+	if err != nil {
+		return "", errors.Wrap(err, "redis xPending")
+	}
+
+	if len(resp) < 2 || resp[1].IsNil() {
+		return "", nil
+	}
+
+	id, err := resp[1].ToString()
+	if err != nil {
+		return "", errors.Wrap(err, "parse pending id")
+	}
+
+	return id, nil
+}
+
+// TrimMaxLen removes the oldest entries of the queue keeping about maxLen of them.
+func (r *Repo) TrimMaxLen(ctx context.Context, queue string, maxLen int64) (int64, error) {
+	trimmed, err := r.rdb.Do(
+		ctx,
+		r.rdb.B().Xtrim().Key(queue).Maxlen().Almost().Threshold(strconv.FormatInt(maxLen, 10)).Build(),
+	).AsInt64()
+	if err != nil {
+		return 0, errors.Wrap(err, "redis xTrim")
+	}
+
+	return trimmed, nil
+}
+
+// TrimMinID removes entries of the queue with ids lower than minID, some of them may be kept
+// since the trimming is approximate.
+func (r *Repo) TrimMinID(ctx context.Context, queue, minID string) (int64, error) {
+	trimmed, err := r.rdb.Do(
+		ctx,
+		r.rdb.B().Xtrim().Key(queue).Minid().Almost().Threshold(minID).Build(),
+	).AsInt64()
+	if err != nil {
+		return 0, errors.Wrap(err, "redis xTrim")
+	}
+
+	return trimmed, nil
+}
+
+// produceExec returns the keys and the arguments of produceScript for the message,
+// the max age of the cap is turned into the min id.
+func (r *Repo) produceExec(
+	queue string, m entity.Message, dedupWindow time.Duration, streamCap entity.StreamCap, cc entity.ClaimCheckPolicy,
+) (rueidis.LuaExec, error) {
+	keys := []string{PriorityQueue(queue, m.Priority), "", ""}
+	if m.IdempotencyKey != "" && dedupWindow > 0 {
+		keys[1] = dedupKey(queue, m.IdempotencyKey)
+	}
+
+	var blob string
+	if cc.Threshold > 0 && len(m.Payload) > cc.Threshold {
+		keys[2] = blobKey(queue)
+		blob, m.Payload, m.ClaimCheck = m.Payload, "", keys[2]
+	}
+
+	data, headers, err := r.encode(queue, m)
+	if err != nil {
+		return rueidis.LuaExec{}, err
+	}
+
+	var threshold string
+
+	switch streamCap.Mode {
+	case entity.CapMaxLen, entity.CapReject:
+		threshold = strconv.FormatInt(streamCap.MaxLen, 10)
+	case entity.CapMinID:
+		threshold = strconv.FormatInt(time.Now().Add(-streamCap.MaxAge).UnixMilli(), 10)
+	}
+
+	args := []string{
+		data,
+		strconv.FormatInt(ceilMilli(dedupWindow), 10),
+		string(streamCap.Mode),
+		threshold,
+		blob,
+		strconv.FormatInt(ceilMilli(cc.TTL), 10),
+	}
+
+	return rueidis.LuaExec{Keys: keys, Args: append(args, headers...)}, nil
+}
+
+// produceErr marks errors other than redis error replies as entity.ErrUnavailable,
+// the message may be produced again later. A cancelled or timed out produce is not marked:
+// the caller gave up on it and the script may have run already.
+func produceErr(err error) error {
+	if strings.Contains(err.Error(), errQueueFull) {
+		return entity.ErrQueueFull
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return errors.Wrap(err, "redis produce script")
+	}
+
+	if _, ok := rueidis.IsRedisErr(err); !ok {
+		return fmt.Errorf("%w: %v", entity.ErrUnavailable, err)
+	}
+
+	return errors.Wrap(err, "redis produce script")
+}
+
+// PriorityQueue returns the stream of the queue for the priority, the normal priority uses the queue itself
+// so the queues produced before priorities were added keep working.
+func PriorityQueue(queue string, p entity.Priority) string {
+	if p == "" || p == entity.PriorityNormal {
+		return queue
+	}
+
+	return queue + ":" + string(p)
+}
+
+func parseMessage(t rueidis.XRangeEntry) (entity.Message, error) {
+	data, ok := t.FieldValues[dataField]
+	if !ok {
+		return entity.Message{}, fmt.Errorf("not found data in task: %v", t.ID)
+	}
+
+	m, err := codec.Decode([]byte(data), parseHeaders(t.FieldValues))
+	if err != nil {
+		return entity.Message{}, errors.Wrap(err, "decode message")
+	}
+
+	m.ID = t.ID
+
+	return m, nil
+}
+
+func parseDeadLetter(fields map[string]string) *entity.DeadLetter {
+	deliveries, _ := strconv.ParseInt(fields[deliveriesField], 10, 64)
+
+	return &entity.DeadLetter{
+		SourceID:   fields[sourceIDField],
+		Error:      fields[errorField],
+		ConsumerID: fields[consumerIDField],
+		Deliveries: deliveries,
+		ProducedAt: parseUnixMilli(fields[producedAtField]),
+		FailedAt:   parseUnixMilli(fields[failedAtField]),
+	}
+}
+
+func parseUnixMilli(s string) time.Time {
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.UnixMilli(ms)
+}
+
+// producedAt returns the time encoded in the stream entry id.
+func producedAt(id string) time.Time {
+	ms, _, _ := strings.Cut(id, "-")
+
+	return parseUnixMilli(ms)
+}
+
+// ceilMilli rounds the duration up to milliseconds, so a positive duration never becomes PX 0
+// which redis rejects.
+func ceilMilli(d time.Duration) int64 {
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// nextID returns the smallest stream id greater than the given one, it is used as an exclusive start of ranges.
+func nextID(id string) string {
+	ms, seq, _ := strings.Cut(id, "-")
+
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil || n == math.MaxUint64 {
+		return strconv.FormatUint(parseUint(ms)+1, 10) + "-0"
+	}
+
+	return ms + "-" + strconv.FormatUint(n+1, 10)
+}
+
+func parseUint(s string) uint64 {
+	n, _ := strconv.ParseUint(s, 10, 64)
+	return n
+}
+
+// deadLetterKey is separate for every group, since groups of one queue handle messages independently.
+func deadLetterKey(queue, group string) string {
+	return queue + ":" + group + ":dlq"
+}
+
+// dedupKey is shared by all priorities of the queue.
+func dedupKey(queue, idempotencyKey string) string {
+	return queue + ":dedup:" + idempotencyKey
+}
+
+func errorsKey(queue, group string) string {
+	return queue + ":" + group + ":errors"
+}
+
+// repeatID repeats the id for every stream of a multi-stream read.
+func repeatID(id string, n int) []string {
+	res := make([]string, n)
+	for i := range res {
+		res[i] = id
+	}
+
+	return res
+}
+
+func mapString(fields map[string]rueidis.RedisMessage, key string) string {
+	v, ok := fields[key]
+	if !ok {
+		return ""
+	}
+
+	s, _ := v.ToString()
+
+	return s
+}
+
+func mapInt64(fields map[string]rueidis.RedisMessage, key string) int64 {
+	v, ok := fields[key]
+	if !ok {
+		return 0
+	}
+
+	n, _ := v.AsInt64()
+
+	return n
+}
@@ -0,0 +1,236 @@
+package redis
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/rueidis"
+	"github.com/veleton777/redis_queue/internal/codec"
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+// newTestRepo returns a repo on the redis at REDIS_TEST_ADDRESS which is flushed before the test,
+// or on an in-memory redis if it is not set.
+func newTestRepo(t *testing.T) *Repo {
+	t.Helper()
+
+	addr, real := os.LookupEnv("REDIS_TEST_ADDRESS")
+	if !real {
+		addr = miniredis.RunT(t).Addr()
+	}
+
+	rdb, err := rueidis.NewClient(rueidis.ClientOption{
+		InitAddress:       []string{addr},
+		DisableCache:      true,
+		ForceSingleClient: true,
+	})
+	if err != nil {
+		t.Fatalf("create redis client: %v", err)
+	}
+
+	t.Cleanup(rdb.Close)
+
+	if real {
+		if err = rdb.Do(context.Background(), rdb.B().Flushdb().Build()).Error(); err != nil {
+			t.Fatalf("flush redis: %v", err)
+		}
+	}
+
+	return NewRepo(rdb)
+}
+
+func TestClaimPendingKeepsIdleTime(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	const queue, group = "q", "g"
+
+	if err := r.RegisterConsumer(ctx, queue, group, "from"); err != nil {
+		t.Fatalf("register consumer: %v", err)
+	}
+
+	var ids []string
+
+	for i := 0; i < 3; i++ {
+		id, err := r.ProduceMsg(ctx, entity.ProduceMessageDTO{Queue: queue, Message: entity.Message{Payload: "p"}})
+		if err != nil {
+			t.Fatalf("produce: %v", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	messages, err := r.Messages(ctx, entity.GetMessagesDTO{ConsumerID: "from", Queues: []string{queue}, Group: group, Limit: 10})
+	if err != nil || len(messages) != 3 {
+		t.Fatalf("read messages: %v, %d messages", err, len(messages))
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	// a deleted message stays pending, it must not stop the hand-over
+	if err = r.rdb.Do(ctx, r.rdb.B().Xdel().Key(queue).Id(ids[0]).Build()).Error(); err != nil {
+		t.Fatalf("xDel: %v", err)
+	}
+
+	var (
+		after   string
+		claimed int
+	)
+
+	for i := 0; ; i++ {
+		if i > len(ids) {
+			t.Fatal("claim pending does not advance")
+		}
+
+		res, err := r.ClaimPending(ctx, entity.ClaimPendingDTO{Queue: queue, Group: group, From: "from", To: "to", Limit: 1, After: after})
+		if err != nil {
+			t.Fatalf("claim pending: %v", err)
+		}
+
+		if res.Last == "" {
+			break
+		}
+
+		after, claimed = res.Last, claimed+res.Claimed
+	}
+
+	if claimed < 2 {
+		t.Fatalf("claimed %d messages, want at least 2", claimed)
+	}
+
+	failed, err := r.FailedMessages(ctx, entity.GetFailedMessagesDTO{
+		ConsumerID: "to", Queue: queue, Group: group, Limit: 10, IdleTimeForMessage: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("failed messages: %v", err)
+	}
+
+	if len(failed) != 2 {
+		t.Fatalf("handed over messages are not reclaimed right away: got %d, want 2", len(failed))
+	}
+}
+
+func TestDeadLetterRecordsOriginID(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	const queue, group = "q", "g"
+
+	if err := r.RegisterConsumer(ctx, queue, group, "c"); err != nil {
+		t.Fatalf("register consumer: %v", err)
+	}
+
+	if _, err := r.ProduceMsg(ctx, entity.ProduceMessageDTO{
+		Queue:   queue,
+		Message: entity.Message{Payload: "p", OriginID: "1700000000000-0", Attempt: 2},
+	}); err != nil {
+		t.Fatalf("produce: %v", err)
+	}
+
+	messages, err := r.Messages(ctx, entity.GetMessagesDTO{ConsumerID: "c", Queues: []string{queue}, Group: group, Limit: 1})
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("read messages: %v, %d messages", err, len(messages))
+	}
+
+	if err = r.DeadLetterMessage(ctx, entity.DeadLetterMessageDTO{
+		Queue: queue, Group: group, ConsumerID: "c", Message: messages[0], Reason: "failed",
+	}); err != nil {
+		t.Fatalf("dead letter: %v", err)
+	}
+
+	dead, err := r.DeadLetterMessages(ctx, entity.GetDeadLetterMessagesDTO{Queue: queue, Group: group, Limit: 10})
+	if err != nil || len(dead) != 1 {
+		t.Fatalf("dead-letter messages: %v, %d messages", err, len(dead))
+	}
+
+	if dl := dead[0].DeadLetter; dl.SourceID != "1700000000000-0" || dl.ProducedAt.UnixMilli() != 1700000000000 {
+		t.Fatalf("dead letter source %q produced at %s, want the origin", dl.SourceID, dl.ProducedAt)
+	}
+
+	if n := pendingCount(t, r, queue, group); n != 0 {
+		t.Fatalf("dead-lettered message is still pending: %d", n)
+	}
+}
+
+func pendingCount(t *testing.T, r *Repo, queue, group string) int64 {
+	t.Helper()
+
+	res, err := r.rdb.Do(context.Background(), r.rdb.B().Xpending().Key(queue).Group(group).Build()).ToArray()
+	if err != nil {
+		t.Fatalf("xPending: %v", err)
+	}
+
+	n, _ := res[0].AsInt64()
+
+	return n
+}
+
+func TestMalformedMessagesDeadLettered(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRepo(t)
+
+	const queue, group = "q", "g"
+
+	if err := r.RegisterConsumer(ctx, queue, group, "c"); err != nil {
+		t.Fatalf("register consumer: %v", err)
+	}
+
+	xAdd := func(fields ...string) string {
+		t.Helper()
+
+		id, err := r.rdb.Do(ctx, r.rdb.B().Xadd().Key(queue).Id("*").FieldValue().FieldValue(fields[0], fields[1]).FieldValue(fields[2], fields[3]).Build()).ToString()
+		if err != nil {
+			t.Fatalf("xAdd: %v", err)
+		}
+
+		return id
+	}
+
+	unknownCodec := xAdd(dataField, "data", headerPrefix+codec.HeaderCodec, "avro")
+
+	valid, err := r.ProduceMsg(ctx, entity.ProduceMessageDTO{Queue: queue, Message: entity.Message{Type: 1, Payload: "p"}})
+	if err != nil {
+		t.Fatalf("produce: %v", err)
+	}
+
+	messages, err := r.Messages(ctx, entity.GetMessagesDTO{ConsumerID: "c", Queues: []string{queue}, Group: group, Limit: 10, DeadLetterQueue: queue})
+	if err != nil || len(messages) != 1 || messages[0].ID != valid {
+		t.Fatalf("read messages: %v, %+v", err, messages)
+	}
+
+	// an entry which was read before it became unreadable, e.g. by an older consumer, is reclaimed
+	badCompression := xAdd(dataField, "data", headerPrefix+codec.HeaderEncoding, "gzip")
+
+	if _, err = r.rdb.Do(ctx, r.rdb.B().Xreadgroup().Group(group, "old").Count(1).Streams().Key(queue).Id(">").Build()).ToAny(); err != nil {
+		t.Fatalf("xReadGroup: %v", err)
+	}
+
+	failed, err := r.FailedMessages(ctx, entity.GetFailedMessagesDTO{ConsumerID: "c", Queue: queue, Group: group, Limit: 10})
+	if err != nil || len(failed) != 1 || failed[0].ID != valid {
+		t.Fatalf("reclaim messages: %v, %+v", err, failed)
+	}
+
+	if pending := pendingCount(t, r, queue, group); pending != 1 {
+		t.Fatalf("%d pending messages, want only the valid one", pending)
+	}
+
+	dead, err := r.DeadLetterMessages(ctx, entity.GetDeadLetterMessagesDTO{Queue: queue, Group: group, Limit: 10})
+	if err != nil || len(dead) != 2 {
+		t.Fatalf("dead letters: %v, %d messages", err, len(dead))
+	}
+
+	for i, id := range []string{unknownCodec, badCompression} {
+		m := dead[i]
+		if m.DeadLetter.SourceID != id || m.Payload != "data" || !strings.Contains(m.DeadLetter.Error, "malformed message") {
+			t.Fatalf("dead letter of %s: %+v, %+v", id, m, m.DeadLetter)
+		}
+	}
+
+	if dead[1].DeadLetter.Deliveries != 2 {
+		t.Fatalf("deliveries of the reclaimed entry: got %d, want 2", dead[1].DeadLetter.Deliveries)
+	}
+}
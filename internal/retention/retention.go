@@ -0,0 +1,182 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veleton777/redis_queue/internal/entity"
+	"github.com/veleton777/redis_queue/internal/logger"
+)
+
+type Policy string
+
+const (
+	// PolicyNone keeps all entries of the queue.
+	PolicyNone Policy = "none"
+	// PolicyMaxLen keeps about MaxLen latest entries.
+	PolicyMaxLen Policy = "maxlen"
+	// PolicyMaxAge removes entries older than MaxAge.
+	PolicyMaxAge Policy = "maxage"
+	// PolicyGroups removes entries that every consumer group of the queue has already received and acked.
+	PolicyGroups Policy = "groups"
+)
+
+type repo interface {
+	TrimMaxLen(ctx context.Context, queue string, maxLen int64) (int64, error)
+	TrimMinID(ctx context.Context, queue, minID string) (int64, error)
+	Groups(ctx context.Context, queue string) ([]entity.GroupInfo, error)
+	OldestPendingID(ctx context.Context, queue, group string) (string, error)
+}
+
+// Retention trims the queue stream, acking messages does not delete them since
+// the same entries may still be needed by other consumer groups.
+type Retention struct {
+	logger logger.Logger
+	repo   repo
+	opts   Opts
+}
+
+type Params struct {
+	Logger logger.Logger
+	Repo   repo
+
+	Opts Opts
+}
+
+type Opts struct {
+	Queue    string
+	Policy   Policy
+	MaxLen   int64
+	MaxAge   time.Duration
+	Interval time.Duration
+}
+
+func New(params Params) *Retention {
+	return &Retention{
+		logger: params.Logger,
+		repo:   params.Repo,
+		opts:   params.Opts,
+	}
+}
+
+func (r *Retention) Run(ctx context.Context) error {
+	if r.opts.Policy == PolicyNone || r.opts.Policy == "" {
+		return nil
+	}
+
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			trimmed, err := r.Trim(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					r.logger.Err(fmt.Sprintf("trim queue: %v\n", err))
+				}
+				continue
+			}
+
+			if trimmed > 0 {
+				r.logger.Info(fmt.Sprintf("%d entries trimmed from queue %s", trimmed, r.opts.Queue))
+			}
+		}
+	}
+}
+
+// Trim applies the policy once and returns the number of removed entries.
+func (r *Retention) Trim(ctx context.Context) (int64, error) {
+	var (
+		trimmed int64
+		err     error
+	)
+
+	switch r.opts.Policy {
+	case PolicyNone, "":
+		return 0, nil
+	case PolicyMaxLen:
+		trimmed, err = r.repo.TrimMaxLen(ctx, r.opts.Queue, r.opts.MaxLen)
+	case PolicyMaxAge:
+		trimmed, err = r.repo.TrimMinID(ctx, r.opts.Queue, strconv.FormatInt(time.Now().Add(-r.opts.MaxAge).UnixMilli(), 10))
+	case PolicyGroups:
+		var minID string
+
+		minID, err = r.groupsMinID(ctx)
+		if err != nil || minID == "" {
+			break
+		}
+
+		trimmed, err = r.repo.TrimMinID(ctx, r.opts.Queue, minID)
+	default:
+		return 0, fmt.Errorf("unknown retention policy: %s", r.opts.Policy)
+	}
+
+	if err != nil {
+		return 0, errors.Wrapf(err, "policy %s", r.opts.Policy)
+	}
+
+	return trimmed, nil
+}
+
+// groupsMinID returns the id of the oldest entry still needed by some group: its oldest pending entry,
+// or the last delivered one if nothing is pending. Empty id means the queue has no groups and nothing is trimmed.
+func (r *Retention) groupsMinID(ctx context.Context) (string, error) {
+	groups, err := r.repo.Groups(ctx, r.opts.Queue)
+	if err != nil {
+		return "", errors.Wrap(err, "get groups")
+	}
+
+	var minID string
+
+	for _, g := range groups {
+		id := g.LastDeliveredID
+
+		if g.Pending > 0 {
+			id, err = r.repo.OldestPendingID(ctx, r.opts.Queue, g.Name)
+			if err != nil {
+				return "", errors.Wrapf(err, "get oldest pending id of group %s", g.Name)
+			}
+		}
+
+		if minID == "" || compareIDs(id, minID) < 0 {
+			minID = id
+		}
+	}
+
+	return minID, nil
+}
+
+// compareIDs compares two stream entry ids of the form <ms>-<seq>.
+func compareIDs(a, b string) int {
+	aMs, aSeq := splitID(a)
+	bMs, bSeq := splitID(b)
+
+	switch {
+	case aMs < bMs:
+		return -1
+	case aMs > bMs:
+		return 1
+	case aSeq < bSeq:
+		return -1
+	case aSeq > bSeq:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func splitID(id string) (uint64, uint64) {
+	ms, seq, _ := strings.Cut(id, "-")
+
+	msN, _ := strconv.ParseUint(ms, 10, 64)
+	seqN, _ := strconv.ParseUint(seq, 10, 64)
+
+	return msN, seqN
+}
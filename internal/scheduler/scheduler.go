@@ -0,0 +1,115 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veleton777/redis_queue/internal/entity"
+	"github.com/veleton777/redis_queue/internal/lock"
+	"github.com/veleton777/redis_queue/internal/logger"
+)
+
+const defaultLimit = 100
+
+type repo interface {
+	PromoteDelayed(ctx context.Context, dto entity.PromoteDelayedDTO) (int64, error)
+}
+
+type locker interface {
+	Do(ctx context.Context, key string, f func(ctx context.Context) error) error
+}
+
+// Scheduler moves delayed messages which are due into the queue. Every message is moved
+// by one atomic redis script, so several schedulers may run for the same queue
+// without duplicating messages, the lock only keeps them from doing the same work at once.
+type Scheduler struct {
+	logger logger.Logger
+	repo   repo
+	locker locker
+	opts   Opts
+}
+
+type Params struct {
+	Logger logger.Logger
+	Repo   repo
+	Locker locker
+
+	Opts Opts
+}
+
+type Opts struct {
+	Queue string
+	// Interval is the time between checks of the delayed queue.
+	Interval time.Duration
+	// Limit is the max number of messages moved by one redis call.
+	Limit int
+}
+
+func New(params Params) *Scheduler {
+	if params.Opts.Limit < 1 {
+		params.Opts.Limit = defaultLimit
+	}
+
+	return &Scheduler{
+		logger: params.Logger,
+		repo:   params.Repo,
+		locker: params.Locker,
+		opts:   params.Opts,
+	}
+}
+
+func (s *Scheduler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			var promoted int64
+
+			err := s.locker.Do(ctx, s.lockKey(), func(ctx context.Context) error {
+				var err error
+				promoted, err = s.Promote(ctx)
+
+				return err
+			})
+			if err != nil && !errors.Is(err, lock.ErrNotAcquired) && ctx.Err() == nil {
+				s.logger.Err(fmt.Sprintf("promote delayed messages: %v\n", err))
+			}
+
+			if promoted > 0 {
+				s.logger.Info(fmt.Sprintf("%d delayed messages promoted to queue %s", promoted, s.opts.Queue))
+			}
+		}
+	}
+}
+
+// Promote moves all due messages into the queue and returns how many of them were moved.
+func (s *Scheduler) Promote(ctx context.Context) (int64, error) {
+	var total int64
+
+	for {
+		promoted, err := s.repo.PromoteDelayed(ctx, entity.PromoteDelayedDTO{
+			Queue: s.opts.Queue,
+			Until: time.Now(),
+			Limit: s.opts.Limit,
+		})
+		total += promoted
+
+		if err != nil {
+			return total, errors.Wrap(err, "promote delayed")
+		}
+
+		if promoted < int64(s.opts.Limit) {
+			return total, nil
+		}
+	}
+}
+
+func (s *Scheduler) lockKey() string {
+	return "lock:scheduler:" + s.opts.Queue
+}
@@ -0,0 +1,56 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+// fakeRepo has due messages, every call promotes up to the limit of them.
+type fakeRepo struct {
+	due   int64
+	err   error
+	calls int
+}
+
+func (r *fakeRepo) PromoteDelayed(_ context.Context, dto entity.PromoteDelayedDTO) (int64, error) {
+	r.calls++
+
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	promoted := min(r.due, int64(dto.Limit))
+	r.due -= promoted
+
+	return promoted, nil
+}
+
+func TestPromote(t *testing.T) {
+	r := &fakeRepo{due: 25}
+	s := New(Params{Repo: r, Opts: Opts{Queue: "q", Limit: 10}})
+
+	promoted, err := s.Promote(context.Background())
+	if err != nil || promoted != 25 {
+		t.Fatalf("promote: %v, %d promoted", err, promoted)
+	}
+
+	if r.calls != 3 {
+		t.Fatalf("%d calls, want 3", r.calls)
+	}
+
+	// a call which fills the limit is followed by one more
+	r.due, r.calls = 10, 0
+
+	if promoted, err = s.Promote(context.Background()); err != nil || promoted != 10 || r.calls != 2 {
+		t.Fatalf("promote the limit: %v, %d promoted in %d calls", err, promoted, r.calls)
+	}
+
+	r.err = errors.New("unavailable")
+
+	if _, err = s.Promote(context.Background()); !errors.Is(err, r.err) {
+		t.Fatalf("promote: got %v, want the repo error", err)
+	}
+}
@@ -0,0 +1,534 @@
+package spool
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veleton777/redis_queue/internal/entity"
+	"github.com/veleton777/redis_queue/internal/logger"
+)
+
+// ErrFull is returned when the message does not fit into the spool.
+var ErrFull = errors.New("spool is full")
+
+// ErrClosed is returned for messages appended after the spool is closed.
+var ErrClosed = errors.New("spool is closed")
+
+// commitEvery is how many replayed messages are committed at once, a crash during the replay
+// produces at most that many messages again.
+const commitEvery = 100
+
+type repo interface {
+	ProduceMsg(ctx context.Context, dto entity.ProduceMessageDTO) (string, error)
+}
+
+// Spool keeps messages which failed to be produced while redis is unreachable in an append-only file
+// and replays them in order once redis is back. The replay position is saved next to the file,
+// so a restart does not replay the messages twice. The replayed part of the file is dropped
+// by rewriting the rest of it into the file of the next generation.
+type Spool struct {
+	logger logger.Logger
+	repo   repo
+	opts   Opts
+
+	// replayMu is held for the whole replay, so the file is not closed or replaced under it.
+	// It is taken before mu by everything that closes or compacts the file.
+	replayMu sync.Mutex
+
+	mu     sync.Mutex
+	file   *os.File
+	gen    int64
+	closed bool
+	// size is the length of the file, offset is the position of the first message not replayed yet
+	size    int64
+	offset  int64
+	entries int64
+}
+
+type Params struct {
+	Logger logger.Logger
+	Repo   repo
+
+	Opts Opts
+}
+
+type Opts struct {
+	Dir   string
+	Queue string
+	// MaxSize is the max size of the spool file in bytes.
+	MaxSize int64
+	// Interval is the time between attempts to replay the spool.
+	Interval time.Duration
+}
+
+// Stats is the state of the spool.
+type Stats struct {
+	// Entries is the number of messages waiting to be replayed.
+	Entries int64
+	// Bytes is the size of the messages waiting to be replayed.
+	Bytes int64
+}
+
+type record struct {
+	Queue       string                  `json:"queue"`
+	Message     entity.Message          `json:"message"`
+	Headers     map[string]string       `json:"headers,omitempty"`
+	DedupWindow time.Duration           `json:"dedup_window"`
+	Cap         entity.StreamCap        `json:"cap"`
+	ClaimCheck  entity.ClaimCheckPolicy `json:"claim_check"`
+}
+
+// New opens the spool file of the queue in the directory, the messages left in it are replayed by Run.
+// Files of other generations are left by a crash during compaction and are removed.
+func New(params Params) (*Spool, error) {
+	if err := os.MkdirAll(params.Opts.Dir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "create spool dir")
+	}
+
+	s := &Spool{
+		logger: params.Logger,
+		repo:   params.Repo,
+		opts:   params.Opts,
+	}
+
+	var err error
+
+	if s.gen, s.offset, err = s.readOffset(); err != nil {
+		return nil, errors.Wrap(err, "read spool offset")
+	}
+
+	if err = s.removeStale(); err != nil {
+		return nil, errors.Wrap(err, "remove stale spool files")
+	}
+
+	f, err := os.OpenFile(s.path(s.gen), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open spool file")
+	}
+
+	s.file = f
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "stat spool file")
+	}
+
+	s.size = info.Size()
+
+	if s.offset > s.size {
+		s.offset = s.size
+	}
+
+	if s.entries, err = s.countEntries(); err != nil {
+		return nil, errors.Wrap(err, "count spool entries")
+	}
+
+	return s, nil
+}
+
+// Append adds the message to the end of the spool, it returns once the message is on disk.
+// The replayed part of the file is dropped if the message does not fit otherwise.
+func (s *Spool) Append(dto entity.ProduceMessageDTO) error {
+	b, err := json.Marshal(record{
+		Queue:       dto.Queue,
+		Message:     dto.Message,
+		Headers:     dto.Message.Headers,
+		DedupWindow: dto.DedupWindow,
+		Cap:         dto.Cap,
+		ClaimCheck:  dto.ClaimCheck,
+	})
+	if err != nil {
+		return errors.Wrap(err, "json marshal")
+	}
+
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	compact := s.overflows(len(b)) && s.offset > 0
+	s.mu.Unlock()
+
+	// compaction replaces the file, so it waits for the replay in progress
+	if compact {
+		s.replayMu.Lock()
+		defer s.replayMu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	if compact && s.overflows(len(b)) && s.offset > 0 {
+		if err = s.compact(); err != nil {
+			return errors.Wrap(err, "compact spool")
+		}
+	}
+
+	if s.overflows(len(b)) {
+		return ErrFull
+	}
+
+	if _, err = s.file.Write(b); err != nil {
+		return errors.Wrap(err, "write spool file")
+	}
+
+	if err = s.file.Sync(); err != nil {
+		return errors.Wrap(err, "sync spool file")
+	}
+
+	s.size += int64(len(b))
+	s.entries++
+
+	return nil
+}
+
+// overflows reports whether n more bytes exceed the max size of the file. It is called with mu held.
+func (s *Spool) overflows(n int) bool {
+	return s.opts.MaxSize > 0 && s.size+int64(n) > s.opts.MaxSize
+}
+
+// Pending reports whether there are messages to replay.
+func (s *Spool) Pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.offset < s.size
+}
+
+func (s *Spool) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return Stats{
+		Entries: s.entries,
+		Bytes:   s.size - s.offset,
+	}
+}
+
+// Close waits for the replay in progress and closes the spool file, messages appended after it
+// are rejected with ErrClosed. It is called by the producer which owns the spool.
+func (s *Spool) Close() error {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+
+	if err := s.file.Close(); err != nil {
+		return errors.Wrap(err, "close spool file")
+	}
+
+	return nil
+}
+
+// Run replays the spool until ctx is cancelled, the spool stays open for the producer.
+func (s *Spool) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			replayed, err := s.Replay(ctx)
+			if err != nil && ctx.Err() == nil {
+				s.logger.Err(fmt.Sprintf("replay spool: %v\n", err))
+			}
+
+			if replayed > 0 {
+				stats := s.Stats()
+				s.logger.Info(fmt.Sprintf("%d spooled messages replayed to queue %s, %d left (%d bytes)",
+					replayed, s.opts.Queue, stats.Entries, stats.Bytes))
+			}
+		}
+	}
+}
+
+// Replay produces the spooled messages in order and returns how many of them were produced.
+// It stops at the first message that fails because redis is unreachable, the queue is full
+// or ctx is done, messages failed by other errors are dropped. The replayed part of the file is dropped
+// once it is at least a half of the file.
+func (s *Spool) Replay(ctx context.Context) (int64, error) {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+
+	s.mu.Lock()
+	offset, end, closed := s.offset, s.size, s.closed
+	s.mu.Unlock()
+
+	if closed || offset == end {
+		return 0, nil
+	}
+
+	replayed, err := s.replayRange(ctx, offset, end)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.offset > 0 && 2*s.offset >= s.size {
+		if cerr := s.compact(); cerr != nil && err == nil {
+			err = errors.Wrap(cerr, "compact spool")
+		}
+	}
+
+	return replayed, err
+}
+
+func (s *Spool) replayRange(ctx context.Context, offset, end int64) (int64, error) {
+	var replayed, read int64
+
+	// the messages read are committed on return, so a stop does not replay them again
+	defer func() {
+		if read > 0 {
+			if err := s.commit(offset, read); err != nil {
+				s.logger.Err(fmt.Sprintf("commit spool offset: %v\n", err))
+			}
+		}
+	}()
+
+	r := bufio.NewReader(io.NewSectionReader(s.file, offset, end-offset))
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return replayed, nil
+		}
+
+		if err != nil {
+			return replayed, errors.Wrap(err, "read spool file")
+		}
+
+		if err = s.replay(ctx, line); err != nil {
+			if errors.Is(err, entity.ErrUnavailable) || errors.Is(err, entity.ErrQueueFull) || ctx.Err() != nil {
+				return replayed, err
+			}
+
+			s.logger.Err(fmt.Sprintf("drop spooled message: %v\n", err))
+		} else {
+			replayed++
+		}
+
+		offset += int64(len(line))
+		read++
+
+		if read == commitEvery {
+			if err = s.commit(offset, read); err != nil {
+				return replayed, errors.Wrap(err, "commit spool offset")
+			}
+
+			read = 0
+		}
+	}
+}
+
+func (s *Spool) replay(ctx context.Context, line []byte) error {
+	var rec record
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return errors.Wrap(err, "json unmarshal")
+	}
+
+	rec.Message.Headers = rec.Headers
+
+	_, err := s.repo.ProduceMsg(ctx, entity.ProduceMessageDTO{
+		Queue:       rec.Queue,
+		Message:     rec.Message,
+		DedupWindow: rec.DedupWindow,
+		Cap:         rec.Cap,
+		ClaimCheck:  rec.ClaimCheck,
+	})
+	if err != nil {
+		return errors.Wrap(err, "produce spooled message")
+	}
+
+	return nil
+}
+
+// commit saves the position of the next message to replay, entries is the number of messages
+// replayed since the last commit.
+func (s *Spool) commit(offset, entries int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.offset = offset
+	s.entries -= entries
+
+	return s.writeOffset(s.gen, s.offset)
+}
+
+// compact moves the messages not replayed yet into the file of the next generation and removes
+// the current file. The new file is used once the offset file points to it, so a crash at any step
+// leaves one complete spool. It is called with replayMu and mu held.
+func (s *Spool) compact() error {
+	gen := s.gen + 1
+
+	f, err := os.OpenFile(s.path(gen), os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "create spool file")
+	}
+
+	if _, err = io.Copy(f, io.NewSectionReader(s.file, s.offset, s.size-s.offset)); err != nil {
+		f.Close()
+		return errors.Wrap(err, "copy spool file")
+	}
+
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "sync spool file")
+	}
+
+	if err = s.writeOffset(gen, 0); err != nil {
+		f.Close()
+		return err
+	}
+
+	old := s.path(s.gen)
+
+	if err = s.file.Close(); err != nil {
+		s.logger.Err(fmt.Sprintf("close spool file: %v\n", err))
+	}
+
+	if err = os.Remove(old); err != nil {
+		s.logger.Err(fmt.Sprintf("remove spool file: %v\n", err))
+	}
+
+	s.file, s.gen = f, gen
+	s.size, s.offset = s.size-s.offset, 0
+
+	return nil
+}
+
+func (s *Spool) countEntries() (int64, error) {
+	var entries int64
+
+	sc := bufio.NewScanner(io.NewSectionReader(s.file, s.offset, s.size-s.offset))
+	sc.Buffer(nil, int(s.size-s.offset)+1)
+
+	for sc.Scan() {
+		entries++
+	}
+
+	return entries, errors.Wrap(sc.Err(), "scan spool file")
+}
+
+// readOffset returns the generation of the spool file and the position in it.
+func (s *Spool) readOffset() (int64, int64, error) {
+	b, err := os.ReadFile(s.offsetPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "read offset file")
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		return 0, 0, errors.Errorf("malformed offset file: %q", b)
+	}
+
+	gen, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "parse generation")
+	}
+
+	offset, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "parse offset")
+	}
+
+	return gen, offset, nil
+}
+
+// writeOffset replaces the offset file atomically, so a crash never leaves it torn.
+func (s *Spool) writeOffset(gen, offset int64) error {
+	tmp := s.offsetPath() + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "create offset file")
+	}
+
+	_, err = f.WriteString(strconv.FormatInt(gen, 10) + " " + strconv.FormatInt(offset, 10))
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "write offset file")
+	}
+
+	if err = os.Rename(tmp, s.offsetPath()); err != nil {
+		return errors.Wrap(err, "rename offset file")
+	}
+
+	return s.syncDir()
+}
+
+func (s *Spool) syncDir() error {
+	d, err := os.Open(s.opts.Dir)
+	if err != nil {
+		return errors.Wrap(err, "open spool dir")
+	}
+	defer d.Close()
+
+	return errors.Wrap(d.Sync(), "sync spool dir")
+}
+
+// removeStale removes the spool files of the queue other than the one of the current generation.
+func (s *Spool) removeStale() error {
+	entries, err := os.ReadDir(s.opts.Dir)
+	if err != nil {
+		return errors.Wrap(err, "read spool dir")
+	}
+
+	current := filepath.Base(s.path(s.gen))
+
+	for _, e := range entries {
+		name := e.Name()
+		if name == current || !strings.HasPrefix(name, s.opts.Queue+".") || !strings.HasSuffix(name, ".spool") {
+			continue
+		}
+
+		gen := strings.TrimSuffix(strings.TrimPrefix(name, s.opts.Queue+"."), ".spool")
+		if _, err = strconv.ParseInt(gen, 10, 64); err != nil {
+			continue
+		}
+
+		if err = os.Remove(filepath.Join(s.opts.Dir, name)); err != nil {
+			return errors.Wrap(err, "remove spool file")
+		}
+	}
+
+	return nil
+}
+
+func (s *Spool) path(gen int64) string {
+	return filepath.Join(s.opts.Dir, s.opts.Queue+"."+strconv.FormatInt(gen, 10)+".spool")
+}
+
+func (s *Spool) offsetPath() string {
+	return filepath.Join(s.opts.Dir, s.opts.Queue+".offset")
+}
@@ -0,0 +1,333 @@
+package spool
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veleton777/redis_queue/internal/entity"
+)
+
+// fakeRepo produces messages into a slice, it fails with err while it is set
+// and is unavailable after limit messages if the limit is set. If paused is set,
+// the produce of message pauseAt signals it and waits for resume.
+type fakeRepo struct {
+	mu       sync.Mutex
+	err      error
+	limit    int
+	produced []string
+
+	pauseAt int
+	paused  chan struct{}
+	resume  chan struct{}
+}
+
+func (r *fakeRepo) ProduceMsg(_ context.Context, dto entity.ProduceMessageDTO) (string, error) {
+	r.mu.Lock()
+	pause := r.paused != nil && len(r.produced) == r.pauseAt
+	r.mu.Unlock()
+
+	if pause {
+		close(r.paused)
+		<-r.resume
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return "", r.err
+	}
+
+	if r.limit > 0 && len(r.produced) == r.limit {
+		return "", entity.ErrUnavailable
+	}
+
+	r.produced = append(r.produced, dto.Message.Payload)
+
+	return strconv.Itoa(len(r.produced)) + "-0", nil
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Err(string)     {}
+func (nopLogger) Info(string)    {}
+func (nopLogger) Success(string) {}
+
+func newTestSpool(t *testing.T, dir string, r *fakeRepo, maxSize int64) *Spool {
+	t.Helper()
+
+	s, err := New(Params{Logger: nopLogger{}, Repo: r, Opts: Opts{Dir: dir, Queue: "q", MaxSize: maxSize}})
+	if err != nil {
+		t.Fatalf("new spool: %v", err)
+	}
+
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func appendN(t *testing.T, s *Spool, from, to int) {
+	t.Helper()
+
+	for i := from; i < to; i++ {
+		if err := s.Append(entity.ProduceMessageDTO{Queue: "q", Message: entity.Message{Payload: strconv.Itoa(i)}}); err != nil {
+			t.Fatalf("append %d: %v", i, err)
+		}
+	}
+}
+
+func assertProduced(t *testing.T, r *fakeRepo, want ...string) {
+	t.Helper()
+
+	if len(r.produced) != len(want) {
+		t.Fatalf("produced %v, want %v", r.produced, want)
+	}
+
+	for i := range want {
+		if r.produced[i] != want[i] {
+			t.Fatalf("produced %v, want %v", r.produced, want)
+		}
+	}
+}
+
+func TestReplayInOrder(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	r := &fakeRepo{err: entity.ErrUnavailable}
+	s := newTestSpool(t, dir, r, 0)
+
+	appendN(t, s, 0, 3)
+
+	if replayed, err := s.Replay(ctx); !errors.Is(err, entity.ErrUnavailable) || replayed != 0 {
+		t.Fatalf("replay while redis is unavailable: %v, %d replayed", err, replayed)
+	}
+
+	if stats := s.Stats(); stats.Entries != 3 {
+		t.Fatalf("stats after a failed replay: %+v", stats)
+	}
+
+	r.err = nil
+
+	if replayed, err := s.Replay(ctx); err != nil || replayed != 3 {
+		t.Fatalf("replay: %v, %d replayed", err, replayed)
+	}
+
+	assertProduced(t, r, "0", "1", "2")
+
+	if s.Pending() || s.Stats() != (Stats{}) {
+		t.Fatalf("spool is not empty after the replay: %+v", s.Stats())
+	}
+}
+
+func TestReplayResumesAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	r := &fakeRepo{}
+
+	s := newTestSpool(t, dir, r, 0)
+	appendN(t, s, 0, commitEvery+10)
+
+	if _, err := s.Replay(ctx); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+
+	appendN(t, s, commitEvery+10, commitEvery+15)
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	r.produced = nil
+	s = newTestSpool(t, dir, r, 0)
+
+	if stats := s.Stats(); stats.Entries != 5 {
+		t.Fatalf("stats after restart: %+v", stats)
+	}
+
+	if _, err := s.Replay(ctx); err != nil {
+		t.Fatalf("replay after restart: %v", err)
+	}
+
+	assertProduced(t, r, "110", "111", "112", "113", "114")
+}
+
+func TestCompactBoundsFile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	r := &fakeRepo{}
+
+	s := newTestSpool(t, dir, r, 0)
+	appendN(t, s, 0, 1)
+
+	lineSize := s.Stats().Bytes
+	s.opts.MaxSize = 4 * lineSize
+
+	appendN(t, s, 1, 4)
+
+	if err := s.Append(entity.ProduceMessageDTO{Queue: "q", Message: entity.Message{Payload: "4"}}); !errors.Is(err, ErrFull) {
+		t.Fatalf("append to the full spool: got %v, want ErrFull", err)
+	}
+
+	r.limit = 1
+
+	if _, err := s.Replay(ctx); !errors.Is(err, entity.ErrUnavailable) {
+		t.Fatalf("replay: got %v, want ErrUnavailable", err)
+	}
+
+	// the replayed part is dropped to make room for new messages
+	appendN(t, s, 4, 5)
+
+	info, err := os.Stat(s.path(s.gen))
+	if err != nil {
+		t.Fatalf("stat spool file: %v", err)
+	}
+
+	if info.Size() != 4*lineSize {
+		t.Fatalf("spool file has %d bytes, want %d", info.Size(), 4*lineSize)
+	}
+
+	if stats := s.Stats(); stats.Entries != 4 || stats.Bytes != 4*lineSize {
+		t.Fatalf("stats after compaction: %+v", stats)
+	}
+
+	if _, err = os.Stat(s.path(0)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("compacted spool file is not removed: %v", err)
+	}
+
+	r.limit = 0
+
+	if _, err = s.Replay(ctx); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+
+	assertProduced(t, r, "0", "1", "2", "3", "4")
+}
+
+func TestRecoverInterruptedCompaction(t *testing.T) {
+	dir := t.TempDir()
+	r := &fakeRepo{}
+
+	s := newTestSpool(t, dir, r, 0)
+	appendN(t, s, 0, 2)
+	s.Close()
+
+	// a crash after the next generation is written but before the offset file points to it
+	if err := os.WriteFile(filepath.Join(dir, "q.1.spool"), []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash while the offset file is written leaves only the temporary file torn
+	if err := os.WriteFile(filepath.Join(dir, "q.offset.tmp"), []byte("1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newTestSpool(t, dir, r, 0)
+
+	if _, err := os.Stat(filepath.Join(dir, "q.1.spool")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("stale spool file is not removed: %v", err)
+	}
+
+	if _, err := s.Replay(context.Background()); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+
+	assertProduced(t, r, "0", "1")
+}
+
+func TestAppendAfterClose(t *testing.T) {
+	s := newTestSpool(t, t.TempDir(), &fakeRepo{}, 0)
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	err := s.Append(entity.ProduceMessageDTO{Queue: "q", Message: entity.Message{Payload: "0"}})
+	if !errors.Is(err, ErrClosed) {
+		t.Fatalf("append after close: got %v, want ErrClosed", err)
+	}
+}
+
+func TestAppendDuringReplay(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	r := &fakeRepo{err: entity.ErrUnavailable}
+
+	s := newTestSpool(t, dir, r, 0)
+	appendN(t, s, 0, 300)
+
+	// the spool is full, so the next message compacts it
+	s.opts.MaxSize = s.Stats().Bytes
+
+	r.mu.Lock()
+	r.err, r.pauseAt, r.paused, r.resume = nil, 150, make(chan struct{}), make(chan struct{})
+	r.mu.Unlock()
+
+	replayErr := make(chan error, 1)
+	go func() {
+		_, err := s.Replay(ctx)
+		replayErr <- err
+	}()
+
+	// the first 100 messages are committed, the replay holds the rest of the file
+	<-r.paused
+
+	appendErr := make(chan error, 1)
+	go func() {
+		appendErr <- s.Append(entity.ProduceMessageDTO{Queue: "q", Message: entity.Message{Payload: "300"}})
+	}()
+
+	// the append has to wait for the replay, which can't be observed, so it is given time to get there
+	time.Sleep(50 * time.Millisecond)
+	close(r.resume)
+
+	if err := <-replayErr; err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+
+	if err := <-appendErr; err != nil {
+		t.Fatalf("append during replay: %v", err)
+	}
+
+	if _, err := s.Replay(ctx); err != nil {
+		t.Fatalf("replay the appended message: %v", err)
+	}
+
+	want := make([]string, 0, 301)
+	for i := 0; i <= 300; i++ {
+		want = append(want, strconv.Itoa(i))
+	}
+
+	assertProduced(t, r, want...)
+
+	if stats := s.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Fatalf("stats after replay: %+v", stats)
+	}
+}
+
+func TestReplayStopsOnCancel(t *testing.T) {
+	dir := t.TempDir()
+	r := &fakeRepo{err: entity.ErrUnavailable}
+	s := newTestSpool(t, dir, r, 0)
+
+	appendN(t, s, 0, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r.err = errors.Wrap(context.Canceled, "produce")
+
+	// the messages are not dropped, they are replayed after the restart
+	if replayed, err := s.Replay(ctx); !errors.Is(err, context.Canceled) || replayed != 0 {
+		t.Fatalf("replay with cancelled context: %v, %d replayed", err, replayed)
+	}
+
+	if stats := s.Stats(); stats.Entries != 3 {
+		t.Fatalf("stats after a cancelled replay: %+v", stats)
+	}
+}